@@ -0,0 +1,320 @@
+package ngroklistener
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(new(AdminAPI))
+}
+
+// AdminAPI is a module that serves the ngrok sessions and tunnels in use
+// through the admin API:
+//   - GET /ngrok/tunnels lists the open tunnels
+//   - POST /ngrok/tunnels opens a tunnel, configured by the body like the
+//     tunnels of the listener wrapper, on the server named by the 'server'
+//     query parameter. It stays open until deleted or the config is reloaded
+//   - DELETE /ngrok/tunnels/{id} closes a tunnel opened through the API
+//   - GET /ngrok/sessions lists the agent sessions
+//   - POST /ngrok/sessions/{id}/restart reconnects a session and reopens its
+//     tunnels
+//   - GET /ngrok/health reports whether the sessions and tunnels of the
+//     servers are up, responding with 503 Service Unavailable if not
+type AdminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.ngrok",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter
+func (a *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/ngrok/tunnels",
+			Handler: caddy.AdminHandlerFunc(a.handleTunnels),
+		},
+		{
+			Pattern: "/ngrok/tunnels/",
+			Handler: caddy.AdminHandlerFunc(a.handleTunnel),
+		},
+		{
+			Pattern: "/ngrok/sessions",
+			Handler: caddy.AdminHandlerFunc(a.handleSessions),
+		},
+		{
+			Pattern: "/ngrok/sessions/",
+			Handler: caddy.AdminHandlerFunc(a.handleSession),
+		},
+		{
+			Pattern: "/ngrok/health",
+			Handler: caddy.AdminHandlerFunc(a.handleHealth),
+		},
+	}
+}
+
+// sessionInfo describes an ngrok agent session in admin API responses.
+type sessionInfo struct {
+	ID                   string     `json:"id"`
+	Region               string     `json:"region,omitempty"`
+	Connected            bool       `json:"connected"`
+	ConnectedSince       *time.Time `json:"connected_since,omitempty"`
+	LastHeartbeat        *time.Time `json:"last_heartbeat,omitempty"`
+	LastHeartbeatLatency string     `json:"last_heartbeat_latency,omitempty"`
+	Tunnels              int        `json:"tunnels"`
+}
+
+// tunnelInfo describes an open ngrok tunnel in admin API responses.
+type tunnelInfo struct {
+	ID         string            `json:"id"`
+	URL        string            `json:"url,omitempty"`
+	Proto      string            `json:"proto,omitempty"`
+	ForwardsTo string            `json:"forwards_to,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Metadata   string            `json:"metadata,omitempty"`
+	Server     string            `json:"server,omitempty"`
+	Session    sessionInfo       `json:"session"`
+}
+
+func newSessionInfo(s *session) sessionInfo {
+	status := s.status()
+
+	info := sessionInfo{
+		ID:        s.id(),
+		Region:    s.region(),
+		Connected: status.Connected,
+		Tunnels:   len(s.registered()),
+	}
+
+	if !status.ConnectedSince.IsZero() {
+		info.ConnectedSince = &status.ConnectedSince
+	}
+
+	if !status.LastHeartbeat.IsZero() {
+		info.LastHeartbeat = &status.LastHeartbeat
+		info.LastHeartbeatLatency = status.Latency.String()
+	}
+
+	return info
+}
+
+func newTunnelInfo(pt *pooledTunnel) tunnelInfo {
+	tun, _ := pt.current()
+
+	return tunnelInfo{
+		ID:         tun.ID(),
+		URL:        tun.URL(),
+		Proto:      tun.Proto(),
+		ForwardsTo: tun.ForwardsTo(),
+		Labels:     tun.Labels(),
+		Metadata:   tun.Metadata(),
+		Server:     pt.serverName(),
+		Session:    newSessionInfo(pt.sess),
+	}
+}
+
+// pooledSessions returns the sessions currently pooled, ordered by ID.
+func pooledSessions() []*session {
+	var all []*session
+	sessions.Range(func(_, val any) bool {
+		all = append(all, val.(*session))
+		return true
+	})
+
+	sort.Slice(all, func(i, j int) bool { return all[i].key < all[j].key })
+
+	return all
+}
+
+// pooledTunnels returns the tunnels currently pooled, ordered by key.
+func pooledTunnels() []*pooledTunnel {
+	var all []*pooledTunnel
+	tunnels.Range(func(_, val any) bool {
+		all = append(all, val.(*pooledTunnel))
+		return true
+	})
+
+	sort.Slice(all, func(i, j int) bool { return all[i].key < all[j].key })
+
+	return all
+}
+
+// findTunnel returns the open tunnel with the given ngrok tunnel ID.
+func findTunnel(id string) *pooledTunnel {
+	for _, pt := range pooledTunnels() {
+		if tun, _ := pt.current(); tun != nil && tun.ID() == id {
+			return pt
+		}
+	}
+
+	return nil
+}
+
+// findSession returns the pooled session with the given ID.
+func findSession(id string) *session {
+	for _, s := range pooledSessions() {
+		if s.id() == id {
+			return s
+		}
+	}
+
+	return nil
+}
+
+func (a *AdminAPI) handleTunnels(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		infos := []tunnelInfo{}
+		for _, pt := range pooledTunnels() {
+			infos = append(infos, newTunnelInfo(pt))
+		}
+
+		return writeJSON(w, http.StatusOK, infos)
+	case http.MethodPost:
+		return a.openTunnel(w, r)
+	default:
+		return errMethodNotAllowed
+	}
+}
+
+func (a *AdminAPI) openTunnel(w http.ResponseWriter, r *http.Request) error {
+	n, err := findWrapper(r.URL.Query().Get("server"))
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        err,
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("reading request body: %v", err),
+		}
+	}
+
+	pt, err := n.openTunnel(body)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("opening ngrok tunnel: %v", err),
+		}
+	}
+
+	return writeJSON(w, http.StatusCreated, newTunnelInfo(pt))
+}
+
+// handleTunnel serves DELETE /ngrok/tunnels/{id}
+func (a *AdminAPI) handleTunnel(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodDelete {
+		return errMethodNotAllowed
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/ngrok/tunnels/")
+
+	pt := findTunnel(id)
+	if pt == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown ngrok tunnel '%s'", id),
+		}
+	}
+
+	n := runtimeWrapper(pt)
+	if n == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusConflict,
+			Err:        fmt.Errorf("ngrok tunnel '%s' is part of the config; remove it from the config instead", id),
+		}
+	}
+
+	if _, err := n.closeRuntimeTunnel(pt); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("closing ngrok tunnel: %v", err),
+		}
+	}
+
+	return nil
+}
+
+func (a *AdminAPI) handleSessions(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return errMethodNotAllowed
+	}
+
+	infos := []sessionInfo{}
+	for _, s := range pooledSessions() {
+		infos = append(infos, newSessionInfo(s))
+	}
+
+	return writeJSON(w, http.StatusOK, infos)
+}
+
+// handleSession serves POST /ngrok/sessions/{id}/restart
+func (a *AdminAPI) handleSession(w http.ResponseWriter, r *http.Request) error {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/ngrok/sessions/"), "/")
+	if action != "restart" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown ngrok session action '%s'", action),
+		}
+	}
+
+	if r.Method != http.MethodPost {
+		return errMethodNotAllowed
+	}
+
+	s := findSession(id)
+	if s == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown ngrok session '%s'", id),
+		}
+	}
+
+	if err := s.restart(r.Context()); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadGateway,
+			Err:        fmt.Errorf("restarting ngrok session: %v", err),
+		}
+	}
+
+	return writeJSON(w, http.StatusOK, newSessionInfo(s))
+}
+
+var errMethodNotAllowed = caddy.APIError{
+	HTTPStatus: http.StatusMethodNotAllowed,
+	Err:        fmt.Errorf("method not allowed"),
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("encoding response: %v", err),
+		}
+	}
+
+	return nil
+}
+
+var (
+	_ caddy.Module      = (*AdminAPI)(nil)
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+)
@@ -0,0 +1,273 @@
+package ngroklistener
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// runCaddy runs a whole Caddy config for the duration of a test.
+func runCaddy(t *testing.T, cfg string) {
+	t.Helper()
+
+	require.Nil(t, caddy.Load([]byte(cfg), true))
+	t.Cleanup(func() { require.Nil(t, caddy.Stop()) })
+}
+
+// adminGet calls an admin API handler and decodes its JSON response into v.
+func adminGet(t *testing.T, handler caddy.AdminHandler, path string, v any) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	require.Nil(t, handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), v))
+}
+
+// adminHandler returns the handler of the admin route for pattern.
+func adminHandler(t *testing.T, pattern string) caddy.AdminHandler {
+	t.Helper()
+
+	for _, route := range new(AdminAPI).Routes() {
+		if route.Pattern == pattern {
+			return route.Handler
+		}
+	}
+
+	t.Fatalf("no admin route %s", pattern)
+	return nil
+}
+
+// adminTestConfig returns a config with two servers wrapped by ngrok, listening
+// on unix sockets in dir so that they do not claim the same address.
+func adminTestConfig(dir string) string {
+	return fmt.Sprintf(`{
+	"admin": {"disabled": true},
+	"apps": {
+		"http": {
+			"servers": {
+				"public": {
+					"listen": ["unix/%s/public.sock"],
+					"listener_wrappers": [{
+						"wrapper": "ngrok",
+						"auth_token": "admin-test",
+						"tunnels": [
+							{"type": "http", "domain": "public.example.com"},
+							{"type": "tcp"}
+						]
+					}]
+				},
+				"internal": {
+					"listen": ["unix/%s/internal.sock"],
+					"listener_wrappers": [{
+						"wrapper": "ngrok",
+						"auth_token": "admin-test",
+						"tunnels": [{"type": "labeled", "labels": {"edge": "edghts_internal"}}]
+					}]
+				}
+			}
+		}
+	}
+}`, dir, dir)
+}
+
+func TestAdminTunnels(t *testing.T) {
+	runCaddy(t, adminTestConfig(t.TempDir()))
+
+	var infos []tunnelInfo
+	adminGet(t, adminHandler(t, "/ngrok/tunnels"), "/ngrok/tunnels", &infos)
+	require.Len(t, infos, 3)
+
+	byServer := map[string][]tunnelInfo{}
+	for _, info := range infos {
+		require.NotEmpty(t, info.ID)
+		require.Equal(t, "caddy", info.ForwardsTo)
+		require.NotEmpty(t, info.Session.ID)
+		require.True(t, info.Session.Connected)
+		require.NotNil(t, info.Session.ConnectedSince)
+		byServer[info.Server] = append(byServer[info.Server], info)
+	}
+
+	require.Len(t, byServer["public"], 2)
+	require.Len(t, byServer["internal"], 1)
+	require.Equal(t, map[string]string{"edge": "edghts_internal"}, byServer["internal"][0].Labels)
+
+	// all tunnels share the one session of the auth token
+	require.Equal(t, byServer["public"][0].Session.ID, byServer["internal"][0].Session.ID)
+}
+
+func TestAdminSessions(t *testing.T) {
+	runCaddy(t, adminTestConfig(t.TempDir()))
+
+	var infos []sessionInfo
+	adminGet(t, adminHandler(t, "/ngrok/sessions"), "/ngrok/sessions", &infos)
+	require.Len(t, infos, 1)
+	require.Equal(t, 3, infos[0].Tunnels)
+	require.True(t, infos[0].Connected)
+	require.Nil(t, infos[0].LastHeartbeat)
+
+	sess := pooledSessions()[0]
+	sess.markHeartbeat(sess.generation, 42*1e6)
+
+	adminGet(t, adminHandler(t, "/ngrok/sessions"), "/ngrok/sessions", &infos)
+	require.NotNil(t, infos[0].LastHeartbeat)
+	require.Equal(t, "42ms", infos[0].LastHeartbeatLatency)
+}
+
+func TestAdminEmpty(t *testing.T) {
+	var tunnels []tunnelInfo
+	adminGet(t, adminHandler(t, "/ngrok/tunnels"), "/ngrok/tunnels", &tunnels)
+	require.NotNil(t, tunnels)
+	require.Empty(t, tunnels)
+}
+
+func TestAdminMethodNotAllowed(t *testing.T) {
+	for _, pattern := range []string{"/ngrok/tunnels", "/ngrok/sessions"} {
+		_, err := adminDo(t, pattern, http.MethodPut, pattern, "")
+		requireAPIError(t, err, http.StatusMethodNotAllowed)
+	}
+}
+
+// adminDo calls the handler of the admin route for pattern.
+func adminDo(t *testing.T, pattern, method, path, body string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	err := adminHandler(t, pattern).ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+
+	return rec, err
+}
+
+// requireAPIError requires err to be an admin API error with status.
+func requireAPIError(t *testing.T, err error, status int) {
+	t.Helper()
+
+	var apiErr caddy.APIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, status, apiErr.HTTPStatus)
+}
+
+func TestAdminOpenTunnel(t *testing.T) {
+	runCaddy(t, adminTestConfig(t.TempDir()))
+
+	rec, err := adminDo(t, "/ngrok/tunnels", http.MethodPost, "/ngrok/tunnels?server=public", `{"type": "http", "domain": "runtime.example.com"}`)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	var info tunnelInfo
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	require.Equal(t, "public", info.Server)
+	require.Equal(t, "https", info.Proto)
+
+	var infos []tunnelInfo
+	adminGet(t, adminHandler(t, "/ngrok/tunnels"), "/ngrok/tunnels", &infos)
+	require.Len(t, infos, 4)
+
+	// the tunnel is served by the public server
+	pt := findTunnel(info.ID)
+	require.NotNil(t, pt)
+	tun, _ := pt.current()
+
+	client, err := tun.(*fakeTunnel).dial()
+	require.Nil(t, err)
+	defer client.Close()
+
+	_, err = io.WriteString(client, "GET / HTTP/1.1\r\nHost: runtime.example.com\r\nConnection: close\r\n\r\n")
+	require.Nil(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestAdminOpenTunnelErrors(t *testing.T) {
+	runCaddy(t, adminTestConfig(t.TempDir()))
+
+	// two servers are wrapped, so one must be chosen
+	_, err := adminDo(t, "/ngrok/tunnels", http.MethodPost, "/ngrok/tunnels", `{"type": "tcp"}`)
+	requireAPIError(t, err, http.StatusNotFound)
+
+	_, err = adminDo(t, "/ngrok/tunnels", http.MethodPost, "/ngrok/tunnels?server=unknown", `{"type": "tcp"}`)
+	requireAPIError(t, err, http.StatusNotFound)
+
+	_, err = adminDo(t, "/ngrok/tunnels", http.MethodPost, "/ngrok/tunnels?server=public", `{"type": "unknown"}`)
+	requireAPIError(t, err, http.StatusBadRequest)
+
+	_, err = adminDo(t, "/ngrok/tunnels", http.MethodPost, "/ngrok/tunnels?server=public", `{"domain": "untyped.example.com"}`)
+	requireAPIError(t, err, http.StatusBadRequest)
+
+	_, err = adminDo(t, "/ngrok/tunnels", http.MethodPost, "/ngrok/tunnels?server=public", `{"type": "http", "unknown": true}`)
+	requireAPIError(t, err, http.StatusBadRequest)
+}
+
+func TestAdminCloseTunnel(t *testing.T) {
+	runCaddy(t, adminTestConfig(t.TempDir()))
+
+	rec, err := adminDo(t, "/ngrok/tunnels", http.MethodPost, "/ngrok/tunnels?server=internal", `{"type": "tcp"}`)
+	require.Nil(t, err)
+
+	var info tunnelInfo
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &info))
+
+	tun, _ := findTunnel(info.ID).current()
+
+	rec, err = adminDo(t, "/ngrok/tunnels/", http.MethodDelete, "/ngrok/tunnels/"+info.ID, "")
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.True(t, tun.(*fakeTunnel).isClosed())
+	require.Nil(t, findTunnel(info.ID))
+
+	_, err = adminDo(t, "/ngrok/tunnels/", http.MethodDelete, "/ngrok/tunnels/"+info.ID, "")
+	requireAPIError(t, err, http.StatusNotFound)
+
+	// tunnels of the config are left to the config
+	configured := pooledTunnels()[0]
+	configuredTun, _ := configured.current()
+
+	_, err = adminDo(t, "/ngrok/tunnels/", http.MethodDelete, "/ngrok/tunnels/"+configuredTun.ID(), "")
+	requireAPIError(t, err, http.StatusConflict)
+	require.False(t, configuredTun.(*fakeTunnel).isClosed())
+
+	_, err = adminDo(t, "/ngrok/tunnels/", http.MethodGet, "/ngrok/tunnels/"+configuredTun.ID(), "")
+	requireAPIError(t, err, http.StatusMethodNotAllowed)
+}
+
+func TestAdminRestartSession(t *testing.T) {
+	runCaddy(t, adminTestConfig(t.TempDir()))
+
+	sess := pooledSessions()[0]
+	before, _ := pooledTunnels()[0].current()
+
+	rec, err := adminDo(t, "/ngrok/sessions/", http.MethodPost, "/ngrok/sessions/"+sess.id()+"/restart", "")
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var info sessionInfo
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	require.Equal(t, sess.id(), info.ID)
+	require.True(t, info.Connected)
+	require.Equal(t, 3, info.Tunnels)
+
+	// the tunnels are reopened on the new session
+	after, _ := pooledTunnels()[0].current()
+	require.True(t, before.(*fakeTunnel).isClosed())
+	require.NotEqual(t, before.ID(), after.ID())
+
+	_, err = adminDo(t, "/ngrok/sessions/", http.MethodPost, "/ngrok/sessions/unknown/restart", "")
+	requireAPIError(t, err, http.StatusNotFound)
+
+	_, err = adminDo(t, "/ngrok/sessions/", http.MethodPost, "/ngrok/sessions/"+sess.id()+"/unknown", "")
+	requireAPIError(t, err, http.StatusNotFound)
+
+	_, err = adminDo(t, "/ngrok/sessions/", http.MethodGet, "/ngrok/sessions/"+sess.id()+"/restart", "")
+	requireAPIError(t, err, http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,171 @@
+package ngroklistener
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"golang.ngrok.com/ngrok"
+)
+
+// authTokenFilePollInterval is how often the auth token file is checked for a
+// new token. Tests shorten it.
+var authTokenFilePollInterval = 10 * time.Second
+
+// provisionAuthTokenFile reads the auth token file, if one is configured.
+func (n *Ngrok) provisionAuthTokenFile() error {
+	if n.AuthTokenFile == "" {
+		return nil
+	}
+
+	if n.AuthToken != "" {
+		return fmt.Errorf("auth_token and auth_token_file cannot both be set")
+	}
+
+	token, err := readSecretFile(n.AuthTokenFile)
+	if err != nil {
+		return err
+	}
+
+	n.fileAuthToken = token
+
+	return nil
+}
+
+// provisionAuthTokenSource resolves the auth token through its secret source,
+// if one is configured.
+func (n *Ngrok) provisionAuthTokenSource(ctx caddy.Context) error {
+	if n.AuthTokenSourceRaw != nil && n.AuthTokenFile != "" {
+		return fmt.Errorf("auth_token_file and auth_token_source cannot both be set")
+	}
+
+	token, _, err := loadSecret(ctx, n, "AuthTokenSourceRaw", n.AuthTokenSourceRaw, n.AuthToken)
+	if err != nil {
+		return err
+	}
+
+	n.sourceAuthToken = token
+
+	return nil
+}
+
+// sessionOpts returns the options to connect a new session with, and the
+// token read from the auth token file, if any. The file is read again, so a
+// session connected after the token rotated uses the new one.
+func (n *Ngrok) sessionOpts() ([]ngrok.ConnectOption, string, error) {
+	if n.AuthTokenFile == "" {
+		return n.opts, "", nil
+	}
+
+	token, err := readSecretFile(n.AuthTokenFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading auth token file: %v", err)
+	}
+
+	return append(slices.Clip(n.opts), ngrok.WithAuthtoken(token)), token, nil
+}
+
+// watchAuthTokenFile polls the auth token file, and re-establishes the
+// session whenever the file holds a token other than the one the session is
+// connected with. A failed reconnect is retried on the next poll.
+func (n *Ngrok) watchAuthTokenFile() {
+	if n.AuthTokenFile == "" {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	n.stopTokenWatch = cancel
+	n.tokenWatchDone = make(chan struct{})
+
+	go func() {
+		defer close(n.tokenWatchDone)
+
+		ticker := time.NewTicker(authTokenFilePollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			token, err := readSecretFile(n.AuthTokenFile)
+			if err != nil {
+				n.l.Warn("reading auth token file", zap.String("path", n.AuthTokenFile), zap.Error(err))
+				continue
+			}
+
+			// a startup still in progress reads the file again
+			if !n.started() || token == n.session.currentAuthtoken() {
+				continue
+			}
+
+			n.l.Info("ngrok auth token changed; reconnecting session", zap.String("path", n.AuthTokenFile))
+
+			if err := n.session.updateAuthtoken(ctx, token); err != nil {
+				n.l.Error("reconnecting ngrok session with the new auth token", zap.Error(err))
+			}
+		}
+	}()
+}
+
+// stopAuthTokenWatch stops watching the auth token file, and waits for a
+// reconnect in progress to give up.
+func (n *Ngrok) stopAuthTokenWatch() {
+	if n.stopTokenWatch == nil {
+		return
+	}
+
+	n.stopTokenWatch()
+	<-n.tokenWatchDone
+}
+
+// currentAuthtoken returns the auth token the session is connected with.
+func (s *session) currentAuthtoken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.authtoken
+}
+
+// updateAuthtoken reconnects the session with a new auth token. A session
+// stopped by a remote command only takes the token, and connects with it when
+// resumed. Wrappers sharing the session all see the token change; only the
+// first one reconnects. The token is kept only once the session reconnected
+// with it, so a failed attempt is retried by the next call. Reconnecting is
+// aborted if ctx is done.
+func (s *session) updateAuthtoken(ctx context.Context, token string) error {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	if s.authtoken == token {
+		return nil
+	}
+
+	opts := s.opts
+	s.opts = append(slices.Clip(s.opts), ngrok.WithAuthtoken(token))
+
+	var err error
+	if !s.halted {
+		err = s.reconnect(ctx)
+	}
+
+	// tunnels failing to reopen do not undo the new session
+	if !s.halted && s.stopped {
+		s.opts = opts
+	} else {
+		s.mu.Lock()
+		s.authtoken = token
+		s.mu.Unlock()
+	}
+
+	if err != nil {
+		s.notify(func(o sessionObserver) { o.sessionDisconnected(s, err) })
+	}
+
+	return err
+}
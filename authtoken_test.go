@@ -0,0 +1,251 @@
+package ngroklistener
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.ngrok.com/ngrok"
+)
+
+func TestNgrokAuthTokenFile(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "authtoken")
+	require.Nil(t, os.WriteFile(tokenFile, []byte("  from-file\n"), 0o600))
+
+	emptyFile := filepath.Join(t.TempDir(), "empty")
+	require.Nil(t, os.WriteFile(emptyFile, []byte("\n"), 0o600))
+
+	cases := genericNgrokTestCases[*Ngrok]{
+		{
+			name: "auth_token_file",
+			caddyInput: `ngrok {
+				auth_token_file ` + tokenFile + `
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, tokenFile, actual.AuthTokenFile)
+			},
+			expectedOptsFunc: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, "from-file", actual.authToken())
+			},
+		},
+		{
+			name: "auth_token_file with auth_token",
+			caddyInput: `ngrok {
+				auth_token foo
+				auth_token_file ` + tokenFile + `
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, "foo", actual.AuthToken)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "auth_token_file empty",
+			caddyInput: `ngrok {
+				auth_token_file ` + emptyFile + `
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, emptyFile, actual.AuthTokenFile)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "auth_token_file missing",
+			caddyInput: `ngrok {
+				auth_token_file ` + filepath.Join(t.TempDir(), "missing") + `
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.NotEmpty(t, actual.AuthTokenFile)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "auth_token_file-no-arg",
+			caddyInput: `ngrok {
+				auth_token_file
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "auth_token_file-too-many-arg",
+			caddyInput: `ngrok {
+				auth_token_file one two
+			}`,
+			expectUnmarshalErr: true,
+		},
+	}
+	cases.runAll(t)
+}
+
+func TestReadSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authtoken")
+
+	require.Nil(t, os.WriteFile(path, []byte("\t token \r\n"), 0o600))
+	token, err := readSecretFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "token", token)
+
+	require.Nil(t, os.WriteFile(path, []byte(" \n"), 0o600))
+	_, err = readSecretFile(path)
+	require.NotNil(t, err)
+
+	_, err = readSecretFile(filepath.Join(t.TempDir(), "missing"))
+	require.NotNil(t, err)
+}
+
+func TestSessionKeyedByAuthTokenFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "authtoken")
+
+	require.Nil(t, os.WriteFile(path, []byte("one"), 0o600))
+	first := &Ngrok{AuthTokenFile: path}
+	require.Nil(t, first.provisionAuthTokenFile())
+
+	require.Nil(t, os.WriteFile(path, []byte("two"), 0o600))
+	second := &Ngrok{AuthTokenFile: path}
+	require.Nil(t, second.provisionAuthTokenFile())
+
+	// the session of a rotated token is picked up by the next config
+	require.Equal(t, first.sessionKey(), second.sessionKey())
+
+	other := &Ngrok{AuthTokenFile: filepath.Join(dir, "other")}
+	require.NotEqual(t, first.sessionKey(), other.sessionKey())
+}
+
+func TestAuthTokenRotation(t *testing.T) {
+	interval := authTokenFilePollInterval
+	authTokenFilePollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { authTokenFilePollInterval = interval })
+
+	var (
+		mu       sync.Mutex
+		connects int
+	)
+	withConnect(t, func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		connects++
+		return &fakeSession{}, nil
+	})
+	connected := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return connects
+	}
+
+	path := filepath.Join(t.TempDir(), "authtoken")
+	require.Nil(t, os.WriteFile(path, []byte("before\n"), 0o600))
+
+	n := provisionNgrok(t, `ngrok {
+		auth_token_file `+path+`
+		tunnel tcp
+	}`)
+	defer n.Cleanup()
+
+	tun := fakeTunnelOf(t, n)
+	require.Equal(t, 1, connected())
+
+	// rewriting the same token does not reconnect
+	require.Nil(t, os.WriteFile(path, []byte("before"), 0o600))
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 1, connected())
+
+	require.Nil(t, os.WriteFile(path, []byte("after\n"), 0o600))
+	require.Eventually(t, func() bool { return connected() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// the tunnel was reopened on the new session
+	require.Eventually(t, func() bool {
+		current, _ := n.pooled[0].current()
+		return current != tun
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, tun.isClosed())
+
+	require.Equal(t, "after", n.session.currentAuthtoken())
+}
+
+func TestAuthTokenRotationRetried(t *testing.T) {
+	interval := authTokenFilePollInterval
+	authTokenFilePollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { authTokenFilePollInterval = interval })
+
+	var (
+		mu       sync.Mutex
+		connects int
+	)
+	withConnect(t, func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		connects++
+		if connects == 2 {
+			return nil, errors.New("authentication failed")
+		}
+		return &fakeSession{}, nil
+	})
+	connected := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return connects
+	}
+
+	path := filepath.Join(t.TempDir(), "authtoken")
+	require.Nil(t, os.WriteFile(path, []byte("before"), 0o600))
+
+	n := provisionNgrok(t, `ngrok {
+		auth_token_file `+path+`
+		tunnel tcp
+	}`)
+	defer n.Cleanup()
+
+	tun := fakeTunnelOf(t, n)
+
+	// the first reconnect fails; the next poll tries again
+	require.Nil(t, os.WriteFile(path, []byte("after"), 0o600))
+	require.Eventually(t, func() bool { return connected() == 3 }, 5*time.Second, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		current, _ := n.pooled[0].current()
+		return current != tun
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "after", n.session.currentAuthtoken())
+	require.True(t, n.session.status().Connected)
+}
+
+func TestAuthTokenRotatedBeforeReload(t *testing.T) {
+	interval := authTokenFilePollInterval
+	authTokenFilePollInterval = time.Hour
+	t.Cleanup(func() { authTokenFilePollInterval = interval })
+
+	created := countingConnect(t)
+
+	path := filepath.Join(t.TempDir(), "authtoken")
+	require.Nil(t, os.WriteFile(path, []byte("before"), 0o600))
+
+	caddyInput := `ngrok {
+		auth_token_file ` + path + `
+		tunnel tcp
+	}`
+
+	old := provisionNgrok(t, caddyInput)
+	require.Len(t, *created, 1)
+
+	// the token rotates before the watcher of the old config notices
+	require.Nil(t, os.WriteFile(path, []byte("after"), 0o600))
+
+	n := provisionNgrok(t, caddyInput)
+	defer n.Cleanup()
+	require.Same(t, old.session, n.session)
+	require.Nil(t, old.Cleanup())
+
+	require.Len(t, *created, 2)
+	require.True(t, (*created)[0].isClosed())
+	require.Equal(t, "after", n.session.currentAuthtoken())
+}
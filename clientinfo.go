@@ -0,0 +1,120 @@
+package ngroklistener
+
+import (
+	"runtime/debug"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// modulePath is the Go module path of this package, used to find its version
+// in the build info of the Caddy binary.
+const modulePath = "github.com/mohammed90/caddy-ngrok-listener"
+
+const defaultClientType = "caddy-ngrok-listener"
+
+// clientInfo identifies the agent to the ngrok service, and in the ngrok
+// dashboard. Fields left empty take their default values.
+type clientInfo struct {
+	// Type defaults to 'caddy-ngrok-listener'.
+	Type string `json:"type,omitempty"`
+
+	// Version defaults to the version of this module.
+	Version string `json:"version,omitempty"`
+
+	// Comments default to the Caddy version.
+	Comments []string `json:"comments,omitempty"`
+}
+
+// clientInfo returns the client info sent to ngrok, with the configured
+// overrides applied.
+func (n *Ngrok) clientInfo() clientInfo {
+	simple, _ := caddy.Version()
+
+	info := clientInfo{
+		Type:     defaultClientType,
+		Version:  moduleVersion(),
+		Comments: []string{"caddy/" + simple},
+	}
+
+	if n.ClientInfo == nil {
+		return info
+	}
+
+	if n.ClientInfo.Type != "" {
+		info.Type = n.ClientInfo.Type
+	}
+
+	if n.ClientInfo.Version != "" {
+		info.Version = n.ClientInfo.Version
+	}
+
+	if len(n.ClientInfo.Comments) > 0 {
+		info.Comments = n.ClientInfo.Comments
+	}
+
+	return info
+}
+
+// moduleVersion returns the version this module was built at.
+func moduleVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	mod := &bi.Main
+	for _, dep := range bi.Deps {
+		if dep.Path == modulePath {
+			mod = dep
+			break
+		}
+	}
+
+	if mod.Path != modulePath {
+		return "unknown"
+	}
+
+	if mod.Replace != nil && mod.Replace.Version != "" {
+		return mod.Replace.Version
+	}
+
+	if mod.Version == "" {
+		return "unknown"
+	}
+
+	return mod.Version
+}
+
+func (ci *clientInfo) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "type":
+			if !d.AllArgs(&ci.Type) {
+				return d.ArgErr()
+			}
+		case "version":
+			if !d.AllArgs(&ci.Version) {
+				return d.ArgErr()
+			}
+		case "comment":
+			var comment string
+			if !d.AllArgs(&comment) {
+				return d.ArgErr()
+			}
+
+			ci.Comments = append(ci.Comments, comment)
+		default:
+			return d.Errf("unrecognized subdirective %s", subdirective)
+		}
+	}
+
+	return nil
+}
+
+var _ caddyfile.Unmarshaler = (*clientInfo)(nil)
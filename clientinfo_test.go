@@ -0,0 +1,131 @@
+package ngroklistener
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNgrokClientInfo(t *testing.T) {
+	cases := genericNgrokTestCases[*Ngrok]{
+		{
+			name: "default",
+			caddyInput: `ngrok {
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Nil(t, actual.ClientInfo)
+			},
+		},
+		{
+			name: "client_info",
+			caddyInput: `ngrok {
+				client_info {
+					type edge-proxy
+					version 1.2.3
+					comment site=ams1
+					comment "fleet=edge"
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, &clientInfo{
+					Type:     "edge-proxy",
+					Version:  "1.2.3",
+					Comments: []string{"site=ams1", "fleet=edge"},
+				}, actual.ClientInfo)
+			},
+		},
+		{
+			name: "client_info with arg",
+			caddyInput: `ngrok {
+				client_info edge-proxy
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "client_info unknown subdirective",
+			caddyInput: `ngrok {
+				client_info {
+					name edge-proxy
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "client_info type-too-many-arg",
+			caddyInput: `ngrok {
+				client_info {
+					type edge proxy
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "client_info comment-no-arg",
+			caddyInput: `ngrok {
+				client_info {
+					comment
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+	}
+	cases.runAll(t)
+}
+
+func TestClientInfoDefaults(t *testing.T) {
+	info := (&Ngrok{}).clientInfo()
+
+	require.Equal(t, "caddy-ngrok-listener", info.Type)
+	require.Equal(t, moduleVersion(), info.Version)
+	require.NotEmpty(t, info.Version)
+	require.Len(t, info.Comments, 1)
+	require.True(t, strings.HasPrefix(info.Comments[0], "caddy/"), info.Comments[0])
+}
+
+func TestClientInfoOverride(t *testing.T) {
+	defaults := (&Ngrok{}).clientInfo()
+
+	info := (&Ngrok{ClientInfo: &clientInfo{Type: "edge-proxy"}}).clientInfo()
+	require.Equal(t, "edge-proxy", info.Type)
+	require.Equal(t, defaults.Version, info.Version)
+	require.Equal(t, defaults.Comments, info.Comments)
+
+	info = (&Ngrok{ClientInfo: &clientInfo{Version: "1.2.3", Comments: []string{"site=ams1"}}}).clientInfo()
+	require.Equal(t, defaults.Type, info.Type)
+	require.Equal(t, "1.2.3", info.Version)
+	require.Equal(t, []string{"site=ams1"}, info.Comments)
+}
+
+func TestClientInfoPlaceholders(t *testing.T) {
+	t.Setenv("NGROK_TEST_SITE", "ams1")
+
+	n := provisionNgrok(t, `ngrok {
+		client_info {
+			comment site={env.NGROK_TEST_SITE}
+		}
+	}`)
+	defer n.Cleanup()
+
+	require.Equal(t, []string{"site=ams1"}, n.clientInfo().Comments)
+}
+
+func TestClientInfoKeysSession(t *testing.T) {
+	created := countingConnect(t)
+
+	first := provisionNgrok(t, `ngrok {
+		client_info {
+			type first
+		}
+	}`)
+	defer first.Cleanup()
+
+	second := provisionNgrok(t, `ngrok {
+		client_info {
+			type second
+		}
+	}`)
+	defer second.Cleanup()
+
+	require.Len(t, *created, 2)
+}
@@ -0,0 +1,141 @@
+package ngroklistener
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"golang.ngrok.com/ngrok"
+)
+
+// Policies for the commands the ngrok service can send to an agent session
+const (
+	commandAllow = "allow"
+	commandDeny  = "deny"
+)
+
+// Remote commands the ngrok service can send to an agent session
+const (
+	commandStop    = "stop"
+	commandRestart = "restart"
+	commandUpdate  = "update"
+)
+
+// remoteCommands configures which commands sent from the ngrok dashboard or
+// API the session accepts. Each is either 'allow' or 'deny'; all are denied
+// by default.
+type remoteCommands struct {
+	// Stop closes the tunnels after draining their connections, then the
+	// session. The session is reconnected by the next config load.
+	Stop string `json:"stop,omitempty"`
+
+	// Restart reconnects the session and reopens its tunnels.
+	Restart string `json:"restart,omitempty"`
+
+	// Update is only reported as an event; Caddy cannot update itself.
+	Update string `json:"update,omitempty"`
+}
+
+func (rc remoteCommands) validate() error {
+	for command, policy := range map[string]string{
+		commandStop:    rc.Stop,
+		commandRestart: rc.Restart,
+		commandUpdate:  rc.Update,
+	} {
+		switch policy {
+		case "", commandAllow, commandDeny:
+		default:
+			return fmt.Errorf("remote command %s: policy must be '%s' or '%s', got '%s'", command, commandAllow, commandDeny, policy)
+		}
+	}
+
+	return nil
+}
+
+// connectOptions returns the ngrok options installing the handlers of the
+// allowed commands on s, and disabling the others.
+func (rc remoteCommands) connectOptions(s *session) []ngrok.ConnectOption {
+	const disabled = "disabled by the Caddy configuration"
+
+	var opts []ngrok.ConnectOption
+
+	if rc.Stop == commandAllow {
+		opts = append(opts, ngrok.WithStopHandler(s.onStop))
+	} else {
+		opts = append(opts, ngrok.WithStopCommandDisabled(disabled))
+	}
+
+	if rc.Restart == commandAllow {
+		opts = append(opts, ngrok.WithRestartHandler(s.onRestart))
+	} else {
+		opts = append(opts, ngrok.WithRestartCommandDisabled(disabled))
+	}
+
+	if rc.Update == commandAllow {
+		opts = append(opts, ngrok.WithUpdateHandler(s.onUpdate))
+	} else {
+		opts = append(opts, ngrok.WithUpdateCommandDisabled(disabled))
+	}
+
+	return opts
+}
+
+// onStop handles a stop command. ngrok-go must not be blocked by command
+// handlers, so the session is stopped in the background.
+func (s *session) onStop(context.Context, ngrok.Session) error {
+	s.notify(func(o sessionObserver) { o.sessionCommand(s, commandStop) })
+
+	go s.stop()
+
+	return nil
+}
+
+// onRestart handles a restart command, reconnecting in the background.
+func (s *session) onRestart(context.Context, ngrok.Session) error {
+	s.notify(func(o sessionObserver) { o.sessionCommand(s, commandRestart) })
+
+	go func() { _ = s.restart(context.Background()) }()
+
+	return nil
+}
+
+// onUpdate handles an update command. It is only reported to the observers.
+func (s *session) onUpdate(context.Context, ngrok.Session) error {
+	s.notify(func(o sessionObserver) { o.sessionCommand(s, commandUpdate) })
+
+	return nil
+}
+
+func (rc *remoteCommands) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		command := d.Val()
+
+		var policy string
+		if !d.AllArgs(&policy) {
+			return d.ArgErr()
+		}
+
+		if policy != commandAllow && policy != commandDeny {
+			return d.Errf("remote command %s: policy must be '%s' or '%s', got '%s'", command, commandAllow, commandDeny, policy)
+		}
+
+		switch command {
+		case commandStop:
+			rc.Stop = policy
+		case commandRestart:
+			rc.Restart = policy
+		case commandUpdate:
+			rc.Update = policy
+		default:
+			return d.Errf("unrecognized remote command %s", command)
+		}
+	}
+
+	return nil
+}
+
+var _ caddyfile.Unmarshaler = (*remoteCommands)(nil)
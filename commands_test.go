@@ -0,0 +1,126 @@
+package ngroklistener
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteCommandsValidate(t *testing.T) {
+	require.Nil(t, remoteCommands{}.validate())
+	require.Nil(t, remoteCommands{Stop: "allow", Restart: "deny", Update: "allow"}.validate())
+	require.NotNil(t, remoteCommands{Restart: "yes"}.validate())
+}
+
+func TestRemoteCommandsKeySession(t *testing.T) {
+	created := countingConnect(t)
+
+	denied := provisionNgrok(t, `ngrok {
+		auth_token commands
+	}`)
+	allowed := provisionNgrok(t, `ngrok {
+		auth_token commands
+		remote_commands {
+			stop allow
+		}
+	}`)
+
+	require.Len(t, *created, 2)
+	require.NotSame(t, denied.session, allowed.session)
+
+	require.Nil(t, denied.Cleanup())
+	require.Nil(t, allowed.Cleanup())
+}
+
+func TestRemoteCommandStop(t *testing.T) {
+	rec := withEvents(t)
+	created := countingConnect(t)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	n := loadNgrok(t, ctx, `{"remote_commands": {"stop": "allow"}}`)
+	defer n.Cleanup()
+	tun := fakeTunnelOf(t, n)
+	conn := acceptOne(t, tun, n.WrapListener(nil))
+
+	require.Nil(t, n.session.onStop(context.Background(), nil))
+
+	// the tunnel is closed right away, the session once it is drained
+	require.Eventually(t, tun.isClosed, time.Second, time.Millisecond)
+	require.False(t, (*created)[0].isClosed())
+
+	require.Nil(t, conn.Close())
+	require.Eventually(t, (*created)[0].isClosed, time.Second, time.Millisecond)
+
+	require.Eventually(t, func() bool { return len(rec.named(eventSessionCommand)) == 1 }, time.Second, time.Millisecond)
+	commands := rec.named(eventSessionCommand)
+	require.Equal(t, commandStop, commands[0].Data["command"])
+
+	// the next config load reconnects the stopped session
+	reloaded := provisionNgrok(t, `ngrok {
+		remote_commands {
+			stop allow
+		}
+	}`)
+	require.Len(t, *created, 2)
+	require.Same(t, n.pooled[0], reloaded.pooled[0])
+	require.False(t, fakeTunnelOf(t, reloaded).isClosed())
+
+	require.Nil(t, reloaded.Cleanup())
+}
+
+func TestRemoteCommandRestart(t *testing.T) {
+	created := countingConnect(t)
+
+	n := provisionNgrok(t, `ngrok {
+		remote_commands {
+			restart allow
+		}
+	}`)
+	old := fakeTunnelOf(t, n)
+	ln := n.WrapListener(nil)
+	conn := acceptOne(t, old, ln)
+
+	require.Nil(t, n.session.onRestart(context.Background(), nil))
+
+	require.Eventually(t, func() bool { return len(n.session.registered()) == 1 && fakeTunnelOf(t, n) != old }, time.Second, time.Millisecond)
+	require.Len(t, *created, 2)
+	require.True(t, (*created)[0].isClosed())
+	require.True(t, old.isClosed())
+
+	// connections accepted before the restart are left open
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err := conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// the same listener accepts from the reopened tunnel
+	require.Nil(t, acceptOne(t, fakeTunnelOf(t, n), ln).Close())
+	require.Nil(t, conn.Close())
+
+	require.Nil(t, n.Cleanup())
+	require.True(t, (*created)[1].isClosed())
+}
+
+func TestRemoteCommandUpdate(t *testing.T) {
+	rec := withEvents(t)
+	created := countingConnect(t)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	n := loadNgrok(t, ctx, `{"remote_commands": {"update": "allow"}}`)
+
+	require.Nil(t, n.session.onUpdate(context.Background(), nil))
+
+	require.Eventually(t, func() bool { return len(rec.named(eventSessionCommand)) == 1 }, time.Second, time.Millisecond)
+	commands := rec.named(eventSessionCommand)
+	require.Equal(t, commandUpdate, commands[0].Data["command"])
+
+	require.Len(t, *created, 1)
+	require.False(t, (*created)[0].isClosed())
+}
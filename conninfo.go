@@ -0,0 +1,153 @@
+package ngroklistener
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.ngrok.com/ngrok"
+	"golang.ngrok.com/ngrok/config"
+)
+
+// Placeholders of the ngrok connection a request arrived on. They are empty
+// for requests served locally.
+const (
+	requestEdgeTypePlaceholder       = "http.request.ngrok.edge_type"
+	requestProtoPlaceholder          = "http.request.ngrok.proto"
+	requestTunnelIDPlaceholder       = "http.request.ngrok.tunnel_id"
+	requestPassthroughTLSPlaceholder = "http.request.ngrok.passthrough_tls"
+)
+
+// connInfoCtxKey is the key of the connInfo in the context of the
+// connections of a server wrapped by ngrok.
+const connInfoCtxKey caddy.CtxKey = "ngrok_conn_info"
+
+// connInfo describes a connection accepted from an ngrok tunnel.
+type connInfo struct {
+	TunnelID  string
+	TunnelURL string
+
+	// the type of the tunnel: http, tcp, tls or labeled
+	TunnelType string
+
+	// the labels of a labeled tunnel
+	Labels map[string]string
+
+	// the type of the edge (https, tls or tcp) that matched the tunnel, if
+	// the tunnel is labeled
+	EdgeType string
+
+	// the protocol the connection was forwarded with (http, https, tls or tcp)
+	Proto string
+
+	// whether the connection carries end-to-end TLS
+	PassthroughTLS bool
+}
+
+// newConnInfo returns the connInfo of conn, or nil if conn was not accepted
+// from an ngrok tunnel.
+func newConnInfo(conn net.Conn) *connInfo {
+	tracked := trackedConnOf(conn)
+	if tracked == nil {
+		return nil
+	}
+
+	info := &connInfo{
+		TunnelType: tunnelType(tracked.tunnel.cfg),
+	}
+
+	if tun, _ := tracked.tunnel.current(); tun != nil {
+		info.TunnelID = tun.ID()
+		info.TunnelURL = tun.URL()
+		info.Labels = tun.Labels()
+	}
+
+	if nc, ok := tracked.Conn.(ngrok.Conn); ok {
+		info.EdgeType = edgeTypeName(nc.EdgeType())
+		info.Proto = nc.Proto()
+		info.PassthroughTLS = nc.PassthroughTLS()
+	}
+
+	return info
+}
+
+// tunnelType returns the type of the tunnel module cfg was configured by.
+func tunnelType(cfg config.Tunnel) string {
+	proto, ok := cfg.(interface{ Proto() string })
+	if !ok {
+		return ""
+	}
+
+	switch p := proto.Proto(); p {
+	case "":
+		return "labeled"
+	case "http", "https":
+		return "http"
+	default:
+		return p
+	}
+}
+
+// edgeTypeName returns the name of an edge type, or an empty string if it is
+// undefined.
+func edgeTypeName(et ngrok.EdgeType) string {
+	switch et {
+	case ngrok.EdgeTypeHTTPS:
+		return "https"
+	case ngrok.EdgeTypeTLS:
+		return "tls"
+	case ngrok.EdgeTypeTCP:
+		return "tcp"
+	default:
+		return ""
+	}
+}
+
+// withConnInfo adds the connInfo of conn to the context of the connection.
+// It is registered as a ConnContext of the server.
+func withConnInfo(ctx context.Context, conn net.Conn) context.Context {
+	info := newConnInfo(conn)
+	if info == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, connInfoCtxKey, info)
+}
+
+// requestConnInfo returns the connInfo of the connection r arrived on, or nil
+// if it was served locally.
+func requestConnInfo(r *http.Request) *connInfo {
+	info, _ := r.Context().Value(connInfoCtxKey).(*connInfo)
+
+	return info
+}
+
+// connInfoPlaceholder returns the value of a connection placeholder for r.
+func connInfoPlaceholder(r *http.Request, key string) (any, bool) {
+	switch key {
+	case requestTunnelURLPlaceholder, requestEdgeTypePlaceholder, requestProtoPlaceholder,
+		requestTunnelIDPlaceholder, requestPassthroughTLSPlaceholder:
+	default:
+		return nil, false
+	}
+
+	info := requestConnInfo(r)
+	if info == nil {
+		return "", true
+	}
+
+	switch key {
+	case requestTunnelURLPlaceholder:
+		return info.TunnelURL, true
+	case requestEdgeTypePlaceholder:
+		return info.EdgeType, true
+	case requestProtoPlaceholder:
+		return info.Proto, true
+	case requestTunnelIDPlaceholder:
+		return info.TunnelID, true
+	default:
+		return strconv.FormatBool(info.PassthroughTLS), true
+	}
+}
@@ -0,0 +1,64 @@
+package ngroklistener
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.ngrok.com/ngrok"
+	"golang.ngrok.com/ngrok/config"
+)
+
+func TestConnInfoPlaceholders(t *testing.T) {
+	dir := t.TempDir()
+	runCaddy(t, placeholdersTestConfig(dir, "{http.request.ngrok.tunnel_id}|{http.request.ngrok.edge_type}|{http.request.ngrok.proto}|{http.request.ngrok.passthrough_tls}"))
+
+	tun, _ := serverTunnel("public").current()
+	fake := tun.(*fakeTunnel)
+	fake.edgeType = ngrok.EdgeTypeTLS
+	fake.passthroughTLS = true
+
+	client, err := fake.dial()
+	require.Nil(t, err)
+	require.Equal(t, fake.ID()+"|tls|https|true", httpGet(t, client))
+
+	local, err := net.Dial("unix", dir+"/public.sock")
+	require.Nil(t, err)
+	require.Equal(t, "|||", httpGet(t, local))
+}
+
+func TestNewConnInfo(t *testing.T) {
+	n := provisionNgrok(t, `ngrok {
+		tunnel tcp
+	}`)
+	defer n.Cleanup()
+
+	fake := fakeTunnelOf(t, n)
+	fake.edgeType = ngrok.EdgeTypeHTTPS
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	info := newConnInfo(&trackedConn{Conn: &fakeConn{Conn: server, tun: fake}, tunnel: n.pooled[0]})
+	require.Equal(t, &connInfo{
+		TunnelID:   fake.ID(),
+		TunnelURL:  fake.URL(),
+		TunnelType: "tcp",
+		EdgeType:   "https",
+		Proto:      "tcp",
+	}, info)
+
+	// connections that are not ngrok.Conns only know their tunnel
+	info = newConnInfo(&trackedConn{Conn: server, tunnel: n.pooled[0]})
+	require.Equal(t, &connInfo{TunnelID: fake.ID(), TunnelURL: fake.URL(), TunnelType: "tcp"}, info)
+
+	require.Nil(t, newConnInfo(localConn{server}))
+}
+
+func TestTunnelType(t *testing.T) {
+	require.Equal(t, "http", tunnelType(config.HTTPEndpoint()))
+	require.Equal(t, "http", tunnelType(config.HTTPEndpoint(config.WithScheme(config.SchemeHTTP))))
+	require.Equal(t, "tcp", tunnelType(config.TCPEndpoint()))
+	require.Equal(t, "tls", tunnelType(config.TLSEndpoint()))
+	require.Equal(t, "labeled", tunnelType(config.LabeledTunnel(config.WithLabel("edge", "edghts_x"))))
+}
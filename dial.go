@@ -0,0 +1,137 @@
+package ngroklistener
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"golang.ngrok.com/ngrok"
+)
+
+// dialOptions configures how the session dials the ngrok ingress, or the
+// proxy in front of it.
+type dialOptions struct {
+	// LocalAddr is the local IP address, optionally with a port, the session
+	// dials from.
+	LocalAddr string `json:"local_addr,omitempty"`
+
+	// Network restricts the session to IPv4 with 'tcp4' or IPv6 with 'tcp6'.
+	// Defaults to 'tcp', which uses either.
+	Network string `json:"network,omitempty"`
+
+	// Timeout is the maximum amount of time a dial waits for a connection to
+	// complete. Defaults to no timeout.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// KeepAlive is the interval between TCP keep-alive probes of the session
+	// connection. Defaults to Go's default; negative disables them.
+	KeepAlive caddy.Duration `json:"keepalive,omitempty"`
+}
+
+// dialer returns the dialer configured by the options.
+func (o *dialOptions) dialer() (ngrok.Dialer, error) {
+	d := &net.Dialer{
+		Timeout:   time.Duration(o.Timeout),
+		KeepAlive: time.Duration(o.KeepAlive),
+	}
+
+	switch o.Network {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported dial network '%s'; must be one of tcp, tcp4, tcp6", o.Network)
+	}
+
+	if o.LocalAddr != "" {
+		addr := o.LocalAddr
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "0")
+		}
+
+		local, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("resolving dial local_addr: %v", err)
+		}
+
+		d.LocalAddr = local
+	}
+
+	return networkDialer{Dialer: d, network: o.Network}, nil
+}
+
+// networkDialer dials with a fixed IP family, whichever network ngrok-go asks
+// for.
+type networkDialer struct {
+	*net.Dialer
+
+	network string
+}
+
+// Dial implements ngrok.Dialer
+func (d networkDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext implements ngrok.Dialer
+func (d networkDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.network != "" {
+		network = d.network
+	}
+
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+func (o *dialOptions) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "local_addr":
+			if !d.AllArgs(&o.LocalAddr) {
+				return d.ArgErr()
+			}
+		case "network":
+			if !d.AllArgs(&o.Network) {
+				return d.ArgErr()
+			}
+		case "timeout":
+			var timeoutStr string
+			if !d.AllArgs(&timeoutStr) {
+				return d.ArgErr()
+			}
+
+			timeout, err := caddy.ParseDuration(timeoutStr)
+			if err != nil {
+				return d.Errf("parsing timeout duration: %v", err)
+			}
+
+			o.Timeout = caddy.Duration(timeout)
+		case "keepalive":
+			var keepAliveStr string
+			if !d.AllArgs(&keepAliveStr) {
+				return d.ArgErr()
+			}
+
+			keepAlive, err := caddy.ParseDuration(keepAliveStr)
+			if err != nil {
+				return d.Errf("parsing keepalive duration: %v", err)
+			}
+
+			o.KeepAlive = caddy.Duration(keepAlive)
+		default:
+			return d.Errf("unrecognized subdirective %s", subdirective)
+		}
+	}
+
+	return nil
+}
+
+var (
+	_ ngrok.Dialer          = networkDialer{}
+	_ caddyfile.Unmarshaler = (*dialOptions)(nil)
+)
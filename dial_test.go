@@ -0,0 +1,155 @@
+package ngroklistener
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNgrokDial(t *testing.T) {
+	cases := genericNgrokTestCases[*Ngrok]{
+		{
+			name: "default",
+			caddyInput: `ngrok {
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Nil(t, actual.Dial)
+			},
+		},
+		{
+			name: "dial",
+			caddyInput: `ngrok {
+				dial {
+					local_addr 127.0.0.1
+					network tcp4
+					timeout 10s
+					keepalive 30s
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, &dialOptions{
+					LocalAddr: "127.0.0.1",
+					Network:   "tcp4",
+					Timeout:   caddy.Duration(10 * time.Second),
+					KeepAlive: caddy.Duration(30 * time.Second),
+				}, actual.Dial)
+			},
+		},
+		{
+			name: "dial unsupported network",
+			caddyInput: `ngrok {
+				dial {
+					network udp
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, "udp", actual.Dial.Network)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "dial invalid local_addr",
+			caddyInput: `ngrok {
+				dial {
+					local_addr not-an-ip:port
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, "not-an-ip:port", actual.Dial.LocalAddr)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "dial with arg",
+			caddyInput: `ngrok {
+				dial tcp4
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "dial unknown subdirective",
+			caddyInput: `ngrok {
+				dial {
+					interface eth0
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "dial timeout parse-err",
+			caddyInput: `ngrok {
+				dial {
+					timeout soon
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "dial keepalive no-arg",
+			caddyInput: `ngrok {
+				dial {
+					keepalive
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+	}
+	cases.runAll(t)
+}
+
+func TestDialerLocalAddr(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	dialer, err := (&dialOptions{LocalAddr: "127.0.0.2"}).dialer()
+	require.Nil(t, err)
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", ln.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	require.Equal(t, "127.0.0.2", conn.LocalAddr().(*net.TCPAddr).IP.String())
+}
+
+func TestDialerNetwork(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	dialer, err := (&dialOptions{Network: "tcp6"}).dialer()
+	require.Nil(t, err)
+
+	// an IPv4 address cannot be dialed over IPv6
+	_, err = dialer.Dial("tcp", ln.Addr().String())
+	require.NotNil(t, err)
+}
+
+func TestDialerThroughProxy(t *testing.T) {
+	stub := newConnectStub(t, "")
+
+	base, err := (&dialOptions{LocalAddr: "127.0.0.2", Network: "tcp4"}).dialer()
+	require.Nil(t, err)
+
+	dialer, err := proxyDialer("http://"+stub.ln.Addr().String(), base)
+	require.Nil(t, err)
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", "connect.ngrok-agent.com:443")
+	require.Nil(t, err)
+	defer conn.Close()
+
+	require.Equal(t, "connect.ngrok-agent.com:443", <-stub.targets)
+	require.Equal(t, "127.0.0.2", conn.LocalAddr().(*net.TCPAddr).IP.String())
+	requireEcho(t, conn)
+}
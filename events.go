@@ -0,0 +1,180 @@
+package ngroklistener
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"go.uber.org/zap"
+)
+
+// Events emitted through Caddy's events app
+const (
+	eventSessionConnected    = "ngrok.session.connected"
+	eventSessionReconnected  = "ngrok.session.reconnected"
+	eventSessionDisconnected = "ngrok.session.disconnected"
+	eventSessionHeartbeat    = "ngrok.session.heartbeat"
+	eventSessionCommand      = "ngrok.session.command"
+	eventTunnelStarted       = "ngrok.tunnel.started"
+	eventTunnelStopped       = "ngrok.tunnel.stopped"
+	eventTunnelURLChanged    = "ngrok.tunnel.url_changed"
+)
+
+// eventsApp returns the events app of the config being provisioned, if any.
+// The http app loads the events app before provisioning its servers, so it is
+// available to listener wrappers. Tests replace this to observe events.
+var eventsApp = func(ctx caddy.Context) *caddyevents.App {
+	app, _ := ctx.AppIfConfigured("events").(*caddyevents.App)
+	return app
+}
+
+// emit emits an event through the events app, if one is configured, and posts
+// it to the notify webhook.
+func (n *Ngrok) emit(name string, data map[string]any) {
+	n.notify(name, data)
+	n.emitEvent(name, data)
+}
+
+// emitSession emits an event of session s. Every wrapper sharing the session
+// posts it to its own webhook, but only one of them emits it through the
+// events app, and does so on the session's queue, so that slow handlers do not
+// hold up ngrok-go's handlers.
+func (n *Ngrok) emitSession(s *session, name string, data map[string]any) {
+	n.notify(name, data)
+
+	if !s.emitsFor(n) {
+		return
+	}
+
+	s.events.push(func() { n.emitEvent(name, data) })
+}
+
+// emitEvent emits an event through the events app, if one is configured. The
+// config context is already cancelled by the time Cleanup runs, which would
+// stop event handlers, so events are emitted on a context detached from it.
+func (n *Ngrok) emitEvent(name string, data map[string]any) {
+	if n.events == nil {
+		return
+	}
+
+	ctx := n.ctx
+	ctx.Context = context.WithoutCancel(n.ctx)
+
+	n.events.Emit(ctx, name, data)
+}
+
+func (n *Ngrok) sessionData(s *session) map[string]any {
+	return map[string]any{
+		"session_id": s.id(),
+		"region":     s.region(),
+	}
+}
+
+func (n *Ngrok) tunnelData(pt *pooledTunnel) map[string]any {
+	tun, _ := pt.current()
+
+	return map[string]any{
+		"session_id":  pt.sess.id(),
+		"tunnel_id":   tun.ID(),
+		"url":         tun.URL(),
+		"proto":       tun.Proto(),
+		"forwards_to": tun.ForwardsTo(),
+		"labels":      tun.Labels(),
+		"metadata":    tun.Metadata(),
+	}
+}
+
+// sessionConnected implements sessionObserver
+func (n *Ngrok) sessionConnected(s *session, reconnected bool) {
+	if n.fallback != nil {
+		n.fallback.deactivate()
+	}
+
+	n.metricSessionConnected(true)
+
+	if reconnected {
+		n.metricSessionReconnected()
+
+		n.l.Info("ngrok session reconnected", zap.String("session_id", s.id()))
+		n.emitSession(s, eventSessionReconnected, n.sessionData(s))
+		return
+	}
+
+	n.emitSession(s, eventSessionConnected, n.sessionData(s))
+}
+
+// sessionDisconnected implements sessionObserver
+func (n *Ngrok) sessionDisconnected(s *session, err error) {
+	if n.fallback != nil {
+		n.fallback.disconnected(err)
+	}
+
+	n.metricSessionConnected(false)
+
+	data := n.sessionData(s)
+	if err != nil {
+		n.l.Warn("ngrok session disconnected", zap.String("session_id", s.id()), zap.Error(err))
+		data["error"] = err.Error()
+	}
+
+	n.emitSession(s, eventSessionDisconnected, data)
+}
+
+// sessionHeartbeat implements sessionObserver
+func (n *Ngrok) sessionHeartbeat(s *session, latency time.Duration) {
+	n.metricSessionHeartbeat(latency)
+
+	data := n.sessionData(s)
+	data["latency"] = latency
+
+	n.emitSession(s, eventSessionHeartbeat, data)
+}
+
+// sessionCommand implements sessionObserver
+func (n *Ngrok) sessionCommand(s *session, command string) {
+	n.l.Info("ngrok remote command received", zap.String("session_id", s.id()), zap.String("command", command))
+
+	data := n.sessionData(s)
+	data["command"] = command
+
+	n.emitSession(s, eventSessionCommand, data)
+}
+
+// serialQueue runs functions one at a time, in the order they are pushed, on
+// a goroutine of its own. The zero value is ready to use.
+type serialQueue struct {
+	mu      sync.Mutex
+	pending []func()
+	running bool
+}
+
+func (q *serialQueue) push(fn func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pending = append(q.pending, fn)
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+}
+
+func (q *serialQueue) run() {
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		fn := q.pending[0]
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+
+		fn()
+	}
+}
+
+var _ sessionObserver = (*Ngrok)(nil)
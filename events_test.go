@@ -0,0 +1,201 @@
+package ngroklistener
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/stretchr/testify/require"
+)
+
+type recordedEvents struct {
+	mu     sync.Mutex
+	events []caddyevents.Event
+}
+
+func (r *recordedEvents) Handle(_ context.Context, e caddyevents.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, e)
+
+	return nil
+}
+
+func (r *recordedEvents) named(name string) []caddyevents.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var events []caddyevents.Event
+	for _, e := range r.events {
+		if e.CloudEvent().Type == name {
+			events = append(events, e)
+		}
+	}
+
+	return events
+}
+
+// withEvents records the events emitted by listener wrappers provisioned
+// during the test.
+func withEvents(t *testing.T) *recordedEvents {
+	t.Helper()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	app := new(caddyevents.App)
+	require.Nil(t, app.Provision(ctx))
+
+	rec := new(recordedEvents)
+	require.Nil(t, app.On("", rec))
+
+	orig := eventsApp
+	eventsApp = func(caddy.Context) *caddyevents.App { return app }
+	t.Cleanup(func() { eventsApp = orig })
+
+	return rec
+}
+
+// loadNgrok loads an Ngrok listener wrapper from JSON the way Caddy does, so
+// that it is the origin of the events it emits.
+func loadNgrok(t *testing.T, ctx caddy.Context, raw string) *Ngrok {
+	t.Helper()
+
+	mod, err := ctx.LoadModuleByID("caddy.listeners.ngrok", json.RawMessage(raw))
+	require.Nil(t, err)
+
+	return mod.(*Ngrok)
+}
+
+func TestTunnelLifecycleEvents(t *testing.T) {
+	rec := withEvents(t)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	n := loadNgrok(t, ctx, `{"tunnels": [{"type": "http"}]}`)
+
+	require.Len(t, rec.named(eventSessionConnected), 1)
+
+	started := rec.named(eventTunnelStarted)
+	require.Len(t, started, 1)
+	tun := fakeTunnelOf(t, n)
+	require.Equal(t, tun.ID(), started[0].Data["tunnel_id"])
+	require.Equal(t, tun.URL(), started[0].Data["url"])
+	require.Equal(t, n.session.id(), started[0].Data["session_id"])
+
+	// unloading the config calls Cleanup with the context already cancelled
+	cancel()
+
+	stopped := rec.named(eventTunnelStopped)
+	require.Len(t, stopped, 1)
+	require.Equal(t, started[0].Data["tunnel_id"], stopped[0].Data["tunnel_id"])
+}
+
+func TestReusedTunnelEmitsNoEvents(t *testing.T) {
+	rec := withEvents(t)
+
+	oldCtx, oldCancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	loadNgrok(t, oldCtx, `{"tunnels": [{"type": "http"}]}`)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	loadNgrok(t, ctx, `{"tunnels": [{"type": "http"}]}`)
+
+	oldCancel()
+
+	require.Len(t, rec.named(eventSessionConnected), 1)
+	require.Len(t, rec.named(eventTunnelStarted), 1)
+	require.Empty(t, rec.named(eventTunnelStopped))
+}
+
+func TestSessionLifecycleEvents(t *testing.T) {
+	rec := withEvents(t)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	n := loadNgrok(t, ctx, `{}`)
+	sess := n.session
+
+	sess.notify(func(o sessionObserver) { o.sessionDisconnected(sess, errors.New("connection reset")) })
+	sess.notify(func(o sessionObserver) { o.sessionConnected(sess, true) })
+	sess.notify(func(o sessionObserver) { o.sessionHeartbeat(sess, 42*time.Millisecond) })
+
+	// session events are emitted in order, off the notifying goroutine
+	require.Eventually(t, func() bool { return len(rec.named(eventSessionHeartbeat)) == 1 }, time.Second, time.Millisecond)
+
+	disconnected := rec.named(eventSessionDisconnected)
+	require.Len(t, disconnected, 1)
+	require.Equal(t, "connection reset", disconnected[0].Data["error"])
+	require.Equal(t, sess.id(), disconnected[0].Data["session_id"])
+
+	require.Len(t, rec.named(eventSessionReconnected), 1)
+
+	heartbeats := rec.named(eventSessionHeartbeat)
+	require.Equal(t, 42*time.Millisecond, heartbeats[0].Data["latency"])
+}
+
+func TestSharedSessionEventsEmittedOnce(t *testing.T) {
+	rec := withEvents(t)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	first := loadNgrok(t, ctx, `{}`)
+	second := loadNgrok(t, ctx, `{}`)
+	require.Same(t, first.session, second.session)
+	sess := first.session
+
+	sess.notify(func(o sessionObserver) { o.sessionDisconnected(sess, errors.New("connection reset")) })
+	sess.notify(func(o sessionObserver) { o.sessionConnected(sess, true) })
+
+	require.Eventually(t, func() bool { return len(rec.named(eventSessionReconnected)) == 1 }, time.Second, time.Millisecond)
+	require.Len(t, rec.named(eventSessionDisconnected), 1)
+
+	// the events are still emitted once the wrapper emitting them is gone
+	require.Nil(t, second.Cleanup())
+
+	sess.notify(func(o sessionObserver) { o.sessionDisconnected(sess, errors.New("connection reset")) })
+	require.Eventually(t, func() bool { return len(rec.named(eventSessionDisconnected)) == 2 }, time.Second, time.Millisecond)
+}
+
+// blockingHandler blocks handling events until it is released.
+type blockingHandler struct {
+	release chan struct{}
+}
+
+func (h blockingHandler) Handle(context.Context, caddyevents.Event) error {
+	<-h.release
+	return nil
+}
+
+func TestSessionEventsDoNotBlockNotifier(t *testing.T) {
+	rec := withEvents(t)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	n := loadNgrok(t, ctx, `{}`)
+	sess := n.session
+
+	handler := blockingHandler{release: make(chan struct{})}
+	require.Nil(t, n.events.On(eventSessionDisconnected, handler))
+
+	notified := make(chan struct{})
+	go func() {
+		sess.notify(func(o sessionObserver) { o.sessionDisconnected(sess, errors.New("connection reset")) })
+		sess.notify(func(o sessionObserver) { o.sessionConnected(sess, true) })
+		close(notified)
+	}()
+
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("a slow event handler held up the session's notifications")
+	}
+
+	close(handler.release)
+	require.Eventually(t, func() bool { return len(rec.named(eventSessionReconnected)) == 1 }, time.Second, time.Millisecond)
+}
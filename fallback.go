@@ -0,0 +1,184 @@
+package ngroklistener
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Fallback modes, for when ngrok cannot be reached
+const fallbackLocal = "local"
+
+const defaultFallbackAfter = 30 * time.Second
+
+func (n *Ngrok) validateFallback() error {
+	switch n.Fallback {
+	case "":
+	case fallbackLocal:
+		if n.KeepLocal {
+			return fmt.Errorf("fallback '%s' has no effect with keep_local", fallbackLocal)
+		}
+	default:
+		return fmt.Errorf("unrecognized fallback '%s'", n.Fallback)
+	}
+
+	return nil
+}
+
+func (n *Ngrok) fallbackAfter() time.Duration {
+	if n.FallbackAfter == 0 {
+		return defaultFallbackAfter
+	}
+
+	return time.Duration(n.FallbackAfter)
+}
+
+// fallback tracks whether the listener passed to WrapListener is used in
+// place of ngrok. It falls back when startup fails, or when the session stays
+// disconnected for longer than after, and recovers once the session connects.
+type fallback struct {
+	l     *zap.Logger
+	after time.Duration
+
+	mu sync.Mutex
+	on bool
+	// closed while falling back
+	active chan struct{}
+	// pending fallback after a disconnect
+	timer *time.Timer
+}
+
+func newFallback(l *zap.Logger, after time.Duration) *fallback {
+	return &fallback{
+		l:      l,
+		after:  after,
+		active: make(chan struct{}),
+	}
+}
+
+// activated returns a channel that is closed while falling back.
+func (f *fallback) activated() <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.active
+}
+
+// activate starts serving on the local listener.
+func (f *fallback) activate(reason string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.timer = nil
+
+	if f.on {
+		return
+	}
+
+	f.on = true
+	close(f.active)
+
+	f.l.Warn("ngrok unavailable; falling back to the local listener", zap.String("reason", reason), zap.Error(err))
+}
+
+// fallingBack reports whether the local listener is in use.
+func (f *fallback) fallingBack() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.on
+}
+
+// deactivate stops serving on the local listener.
+func (f *fallback) deactivate() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stopTimer()
+
+	if !f.on {
+		return
+	}
+
+	f.on = false
+	f.active = make(chan struct{})
+
+	f.l.Info("ngrok recovered; no longer serving on the local listener")
+}
+
+// disconnected schedules falling back unless the session reconnects in time.
+func (f *fallback) disconnected(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.on || f.timer != nil {
+		return
+	}
+
+	f.timer = time.AfterFunc(f.after, func() {
+		f.activate(fmt.Sprintf("disconnected for more than %s", f.after), err)
+	})
+}
+
+// stop cancels a pending fallback.
+func (f *fallback) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stopTimer()
+}
+
+func (f *fallback) stopTimer() {
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+}
+
+// fallbackListener accepts from the local listener only while falling back.
+// A connection accepted once ngrok recovered is closed rather than served.
+type fallbackListener struct {
+	net.Listener
+
+	fallback *fallback
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newFallbackListener(ln net.Listener, f *fallback) *fallbackListener {
+	return &fallbackListener{
+		Listener: ln,
+		fallback: f,
+		closed:   make(chan struct{}),
+	}
+}
+
+// Accept implements net.Listener
+func (l *fallbackListener) Accept() (net.Conn, error) {
+	for {
+		select {
+		case <-l.fallback.activated():
+		case <-l.closed:
+			return nil, net.ErrClosed
+		}
+
+		conn, err := l.Listener.Accept()
+		if err != nil || l.fallback.fallingBack() {
+			return conn, err
+		}
+
+		// ngrok recovered while waiting for the connection
+		_ = conn.Close()
+	}
+}
+
+// Close implements net.Listener
+func (l *fallbackListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+
+	return l.Listener.Close()
+}
@@ -0,0 +1,245 @@
+package ngroklistener
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// isFallingBack reports whether the local listener is in use.
+func isFallingBack(f *fallback) bool {
+	select {
+	case <-f.activated():
+		return true
+	default:
+		return false
+	}
+}
+
+// acceptLocal dials the local listener and accepts the connection on ln.
+func acceptLocal(t *testing.T, local, ln net.Listener) net.Conn {
+	t.Helper()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		require.Nil(t, err)
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("tcp", local.Addr().String())
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	return <-accepted
+}
+
+func TestNgrokFallback(t *testing.T) {
+	cases := genericNgrokTestCases[*Ngrok]{
+		{
+			name: "default",
+			caddyInput: `ngrok {
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Empty(t, actual.Fallback)
+			},
+			expectedOptsFunc: func(t *testing.T, actual *Ngrok) {
+				require.Nil(t, actual.fallback)
+			},
+		},
+		{
+			name: "fallback local",
+			caddyInput: `ngrok {
+				fallback local
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, fallbackLocal, actual.Fallback)
+				require.Empty(t, actual.FallbackAfter)
+			},
+			expectedOptsFunc: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, defaultFallbackAfter, actual.fallback.after)
+				require.False(t, isFallingBack(actual.fallback))
+			},
+		},
+		{
+			name: "fallback local after",
+			caddyInput: `ngrok {
+				fallback local 1m
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, caddy.Duration(time.Minute), actual.FallbackAfter)
+			},
+			expectedOptsFunc: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, time.Minute, actual.fallback.after)
+			},
+		},
+		{
+			name: "fallback with keep_local",
+			caddyInput: `ngrok {
+				fallback local
+				keep_local
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.True(t, actual.KeepLocal)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "fallback unknown mode",
+			caddyInput: `ngrok {
+				fallback remote
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "fallback-no-arg",
+			caddyInput: `ngrok {
+				fallback
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "fallback parse-err",
+			caddyInput: `ngrok {
+				fallback local soon
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "fallback-too-many-arg",
+			caddyInput: `ngrok {
+				fallback local 1m 2m
+			}`,
+			expectUnmarshalErr: true,
+		},
+	}
+	cases.runAll(t)
+}
+
+func TestFallbackOnStartupFailure(t *testing.T) {
+	withStartupBackoff(t)
+
+	var up atomic.Bool
+	flakyConnect(t, &up)
+
+	n := provisionNgrok(t, `ngrok {
+		fallback local
+	}`)
+	defer n.Cleanup()
+
+	require.True(t, isFallingBack(n.fallback))
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	ln := n.WrapListener(local)
+	defer ln.Close()
+
+	conn := acceptLocal(t, local, ln)
+	require.Equal(t, sourceLocal, conn.(sourcedConn).Source())
+	require.Nil(t, conn.Close())
+
+	// once ngrok is reachable, the tunnel is served instead
+	up.Store(true)
+	<-n.ready
+	require.Eventually(t, func() bool { return !isFallingBack(n.fallback) }, time.Second, time.Millisecond)
+
+	conn = acceptOne(t, fakeTunnelOf(t, n), ln)
+	require.Equal(t, sourceNgrok, conn.(sourcedConn).Source())
+	require.Nil(t, conn.Close())
+}
+
+func TestFallbackAfterDisconnect(t *testing.T) {
+	n := provisionNgrok(t, `ngrok {
+		fallback local 20ms
+	}`)
+	defer n.Cleanup()
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	ln := n.WrapListener(local)
+	defer ln.Close()
+
+	// a disconnect shorter than the threshold does not fall back
+	n.sessionDisconnected(n.session, errors.New("connection reset"))
+	n.sessionConnected(n.session, true)
+	time.Sleep(40 * time.Millisecond)
+	require.False(t, isFallingBack(n.fallback))
+
+	n.sessionDisconnected(n.session, errors.New("connection reset"))
+	require.Eventually(t, func() bool { return isFallingBack(n.fallback) }, time.Second, time.Millisecond)
+
+	conn := acceptLocal(t, local, ln)
+	require.Equal(t, sourceLocal, conn.(sourcedConn).Source())
+	require.Nil(t, conn.Close())
+
+	n.sessionConnected(n.session, true)
+	require.False(t, isFallingBack(n.fallback))
+}
+
+func TestFallbackListenerClose(t *testing.T) {
+	f := newFallback(caddy.Log(), time.Minute)
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	ln := newFallbackListener(local, f)
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		accepted <- err
+	}()
+
+	require.Nil(t, ln.Close())
+	require.ErrorIs(t, <-accepted, net.ErrClosed)
+}
+
+func TestFallbackListenerRecovered(t *testing.T) {
+	f := newFallback(caddy.Log(), time.Minute)
+	f.activate("testing", nil)
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	ln := newFallbackListener(local, f)
+	defer ln.Close()
+
+	conn := acceptLocal(t, local, ln)
+	require.Nil(t, conn.Close())
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	// let the accept block on the local listener before ngrok recovers
+	time.Sleep(20 * time.Millisecond)
+	f.deactivate()
+
+	client, err := net.Dial("tcp", local.Addr().String())
+	require.Nil(t, err)
+	defer client.Close()
+
+	// the connection is closed rather than served
+	require.Nil(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = client.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	select {
+	case <-accepted:
+		t.Fatal("connection accepted after recovering")
+	default:
+	}
+
+	require.Nil(t, ln.Close())
+	require.Nil(t, <-accepted)
+}
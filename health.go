@@ -0,0 +1,161 @@
+package ngroklistener
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// The heartbeat settings ngrok uses when they are not configured.
+const (
+	defaultHeartbeatInterval  = 10 * time.Second
+	defaultHeartbeatTolerance = 15 * time.Second
+)
+
+// healthReport is the response of the health endpoint of the admin API.
+type healthReport struct {
+	Healthy  bool           `json:"healthy"`
+	Servers  []serverHealth `json:"servers"`
+	Problems []string       `json:"problems,omitempty"`
+}
+
+// serverHealth describes the ngrok connectivity of a server.
+type serverHealth struct {
+	Server             string       `json:"server"`
+	Healthy            bool         `json:"healthy"`
+	Session            *sessionInfo `json:"session,omitempty"`
+	ExpectedTunnels    int          `json:"expected_tunnels"`
+	EstablishedTunnels int          `json:"established_tunnels"`
+	Problems           []string     `json:"problems,omitempty"`
+}
+
+// latestWrappers returns the most recently provisioned wrapper of each
+// server, ordered by server name.
+func latestWrappers() []*Ngrok {
+	wrappersMu.Lock()
+	defer wrappersMu.Unlock()
+
+	latest := map[string]*Ngrok{}
+	for _, w := range wrappers {
+		latest[w.server] = w
+	}
+
+	all := make([]*Ngrok, 0, len(latest))
+	for _, w := range latest {
+		all = append(all, w)
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].server < all[j].server })
+
+	return all
+}
+
+// maxHeartbeatAge is how long the session of the wrapper may go without a
+// heartbeat before it is considered unhealthy: a heartbeat interval plus the
+// tolerance for its response.
+func (n *Ngrok) maxHeartbeatAge() time.Duration {
+	interval, tolerance := time.Duration(n.HeartbeatInterval), time.Duration(n.HeartbeatTolerance)
+	if interval == 0 {
+		interval = defaultHeartbeatInterval
+	}
+	if tolerance == 0 {
+		tolerance = defaultHeartbeatTolerance
+	}
+
+	return interval + tolerance
+}
+
+// health checks the session and tunnels of the wrapper as of now.
+func (n *Ngrok) health(now time.Time) serverHealth {
+	h := serverHealth{
+		Server:          n.server,
+		ExpectedTunnels: len(n.tunnels),
+	}
+
+	if !n.started() || n.session == nil {
+		h.Problems = append(h.Problems, "ngrok session is not established yet")
+		return h
+	}
+
+	info := newSessionInfo(n.session)
+	h.Session = &info
+
+	status := n.session.status()
+	if !status.Connected {
+		h.Problems = append(h.Problems, "ngrok session is disconnected")
+	} else {
+		last := status.LastHeartbeat
+		if last.IsZero() {
+			last = status.ConnectedSince
+		}
+
+		if age := now.Sub(last); age > n.maxHeartbeatAge() {
+			h.Problems = append(h.Problems, fmt.Sprintf("no ngrok heartbeat for %s", age.Round(time.Second)))
+		}
+	}
+
+	for _, pt := range n.pooled {
+		if pt.up() {
+			h.EstablishedTunnels++
+		}
+	}
+
+	if h.EstablishedTunnels < h.ExpectedTunnels {
+		h.Problems = append(h.Problems, fmt.Sprintf("%d of %d ngrok tunnels are established", h.EstablishedTunnels, h.ExpectedTunnels))
+	}
+
+	h.Healthy = len(h.Problems) == 0
+
+	return h
+}
+
+// handleHealth serves GET /ngrok/health, which responds with 503 Service
+// Unavailable unless the ngrok session and tunnels of every server, or of the
+// one named by the 'server' query parameter, are up.
+func (a *AdminAPI) handleHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return errMethodNotAllowed
+	}
+
+	var checked []*Ngrok
+	if server := r.URL.Query().Get("server"); server != "" {
+		n, err := findWrapper(server)
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        err,
+			}
+		}
+
+		checked = []*Ngrok{n}
+	} else {
+		checked = latestWrappers()
+	}
+
+	report := healthReport{
+		Healthy: true,
+		Servers: []serverHealth{},
+	}
+
+	if len(checked) == 0 {
+		report.Healthy = false
+		report.Problems = []string{errNoWrapper.Error()}
+	}
+
+	now := time.Now()
+	for _, n := range checked {
+		h := n.health(now)
+		report.Healthy = report.Healthy && h.Healthy
+		report.Servers = append(report.Servers, h)
+	}
+
+	status := http.StatusOK
+	if !report.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+
+	return writeJSON(w, status, report)
+}
@@ -0,0 +1,103 @@
+package ngroklistener
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// adminHealth calls the health endpoint and decodes its report.
+func adminHealth(t *testing.T, path string) (int, healthReport) {
+	t.Helper()
+
+	rec, err := adminDo(t, "/ngrok/health", http.MethodGet, path, "")
+	require.Nil(t, err)
+
+	var report healthReport
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &report))
+
+	return rec.Code, report
+}
+
+func TestAdminHealth(t *testing.T) {
+	runCaddy(t, adminTestConfig(t.TempDir()))
+
+	code, report := adminHealth(t, "/ngrok/health")
+	require.Equal(t, http.StatusOK, code)
+	require.True(t, report.Healthy)
+	require.Len(t, report.Servers, 2)
+	require.Equal(t, "internal", report.Servers[0].Server)
+	require.Equal(t, "public", report.Servers[1].Server)
+	require.Equal(t, 2, report.Servers[1].ExpectedTunnels)
+	require.Equal(t, 2, report.Servers[1].EstablishedTunnels)
+	require.True(t, report.Servers[1].Session.Connected)
+
+	// a tunnel going down makes its server unhealthy
+	n, err := findWrapper("public")
+	require.Nil(t, err)
+	tun, _ := n.pooled[1].current()
+	require.Nil(t, tun.Close())
+	require.Eventually(t, func() bool { return !n.pooled[1].up() }, time.Second, 10*time.Millisecond)
+
+	code, report = adminHealth(t, "/ngrok/health")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.False(t, report.Healthy)
+	require.True(t, report.Servers[0].Healthy)
+	require.False(t, report.Servers[1].Healthy)
+	require.Equal(t, []string{"1 of 2 ngrok tunnels are established"}, report.Servers[1].Problems)
+
+	code, report = adminHealth(t, "/ngrok/health?server=internal")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, report.Servers, 1)
+
+	_, err = adminDo(t, "/ngrok/health", http.MethodGet, "/ngrok/health?server=unknown", "")
+	requireAPIError(t, err, http.StatusNotFound)
+
+	_, err = adminDo(t, "/ngrok/health", http.MethodPost, "/ngrok/health", "")
+	requireAPIError(t, err, http.StatusMethodNotAllowed)
+}
+
+func TestAdminHealthEmpty(t *testing.T) {
+	code, report := adminHealth(t, "/ngrok/health")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.False(t, report.Healthy)
+	require.Empty(t, report.Servers)
+	require.Equal(t, []string{errNoWrapper.Error()}, report.Problems)
+}
+
+func TestHealth(t *testing.T) {
+	n := provisionNgrok(t, `ngrok {
+		heartbeat_interval 1s
+		heartbeat_tolerance 2s
+	}`)
+	defer n.Cleanup()
+
+	require.Equal(t, 3*time.Second, n.maxHeartbeatAge())
+
+	now := time.Now()
+	h := n.health(now)
+	require.True(t, h.Healthy)
+	require.Equal(t, 1, h.ExpectedTunnels)
+	require.Equal(t, 1, h.EstablishedTunnels)
+
+	// without heartbeats, the session is stale once it has been connected
+	// for longer than the heartbeat tolerance allows
+	h = n.health(now.Add(5 * time.Second))
+	require.False(t, h.Healthy)
+	require.Equal(t, []string{"no ngrok heartbeat for 5s"}, h.Problems)
+
+	n.session.markHeartbeat(n.session.generation, time.Millisecond)
+	require.True(t, n.health(time.Now().Add(2*time.Second)).Healthy)
+
+	n.session.markDisconnected(n.session.generation)
+	h = n.health(time.Now())
+	require.False(t, h.Healthy)
+	require.Equal(t, []string{"ngrok session is disconnected"}, h.Problems)
+}
+
+func TestMaxHeartbeatAge(t *testing.T) {
+	require.Equal(t, 25*time.Second, new(Ngrok).maxHeartbeatAge())
+}
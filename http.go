@@ -1,6 +1,7 @@
 package ngroklistener
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 
@@ -14,6 +15,9 @@ func init() {
 	caddy.RegisterModule(new(HTTP))
 }
 
+// minLenBasicAuthPassword is the shortest password ngrok accepts for basic auth.
+const minLenBasicAuthPassword = 8
+
 // ngrok HTTP tunnel
 type HTTP struct {
 	opts []config.HTTPEndpointOption
@@ -61,6 +65,33 @@ type HTTP struct {
 type basicAuthCred struct {
 	Username string `json:"username,omitempty"`
 	Password string `json:"password,omitempty"`
+
+	// PasswordSourceRaw resolves the password through a secret source
+	// module, as an alternative to password.
+	PasswordSourceRaw json.RawMessage `json:"password_source,omitempty" caddy:"namespace=caddy.listeners.ngrok.secrets inline_key=source"`
+
+	// the password in use, resolved from its source if it has one
+	password string
+}
+
+// provision resolves the password of the credential.
+func (c *basicAuthCred) provision(ctx caddy.Context) error {
+	c.password = c.Password
+
+	password, ok, err := loadSecret(ctx, c, "PasswordSourceRaw", c.PasswordSourceRaw, c.Password)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		if len(password) < minLenBasicAuthPassword {
+			return fmt.Errorf("password must be at least eight characters")
+		}
+
+		c.password = password
+	}
+
+	return nil
 }
 
 // CaddyModule implements caddy.Module
@@ -126,8 +157,13 @@ func (t *HTTP) provisionOpts(ctx caddy.Context) error {
 		t.opts = append(t.opts, config.WithWebsocketTCPConversion())
 	}
 
-	for _, basic_auth := range t.BasicAuth {
-		t.opts = append(t.opts, config.WithBasicAuth(basic_auth.Username, basic_auth.Password))
+	for i := range t.BasicAuth {
+		basic_auth := &t.BasicAuth[i]
+		if err := basic_auth.provision(ctx); err != nil {
+			return fmt.Errorf("provisioning basic_auth of '%s': %v", basic_auth.Username, err)
+		}
+
+		t.opts = append(t.opts, config.WithBasicAuth(basic_auth.Username, basic_auth.password))
 	}
 
 	if t.OIDC != nil {
@@ -199,16 +235,34 @@ func (t *HTTP) doReplace() {
 		t.DenyCIDR[index] = actual
 	}
 
-	for i, basic_auth := range t.BasicAuth {
-		actualUsername := repl.ReplaceKnown(basic_auth.Username, "")
+	for i := range t.BasicAuth {
+		basic_auth := &t.BasicAuth[i]
 
-		actualPassword := repl.ReplaceKnown(basic_auth.Password, "")
+		basic_auth.Username = repl.ReplaceKnown(basic_auth.Username, "")
 
-		t.BasicAuth[i] = basicAuthCred{Username: actualUsername, Password: actualPassword}
+		basic_auth.Password = repl.ReplaceKnown(basic_auth.Password, "")
 
 	}
 }
 
+// secrets implements secretHolder
+func (t *HTTP) secrets() []string {
+	var secrets []string
+	for _, basic_auth := range t.BasicAuth {
+		secrets = append(secrets, basic_auth.password)
+	}
+
+	if t.OIDC != nil {
+		secrets = append(secrets, t.OIDC.clientSecret)
+	}
+
+	if t.WebhookVerification != nil {
+		secrets = append(secrets, t.WebhookVerification.secret)
+	}
+
+	return secrets
+}
+
 // convert to ngrok's Tunnel type
 func (t *HTTP) NgrokTunnel() config.Tunnel {
 	return config.HTTPEndpoint(t.opts...)
@@ -259,6 +313,10 @@ func (t *HTTP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if err := t.unmarshalBasicAuth(d); err != nil {
 					return err
 				}
+			case "basic_auth_source":
+				if err := t.unmarshalBasicAuthSource(d); err != nil {
+					return err
+				}
 			case "oidc":
 				if err := t.unmarshalOIDC(d); err != nil {
 					return err
@@ -350,8 +408,6 @@ func (t *HTTP) unmarshalBasicAuth(d *caddyfile.Dispenser) error {
 		foundBasicAuth bool
 	)
 
-	minLenPassword := 8
-
 	if d.NextArg() { // basic_auth is defined inline
 
 		username = d.Val()
@@ -363,7 +419,7 @@ func (t *HTTP) unmarshalBasicAuth(d *caddyfile.Dispenser) error {
 
 		foundBasicAuth = true
 
-		if len(password) < minLenPassword {
+		if len(password) < minLenBasicAuthPassword {
 			return d.Err("password must be at least eight characters.")
 		}
 
@@ -383,7 +439,7 @@ func (t *HTTP) unmarshalBasicAuth(d *caddyfile.Dispenser) error {
 
 		foundBasicAuth = true
 
-		if len(password) < minLenPassword {
+		if len(password) < minLenBasicAuthPassword {
 			return d.Err("password must be at least eight characters.")
 		}
 
@@ -397,6 +453,22 @@ func (t *HTTP) unmarshalBasicAuth(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+func (t *HTTP) unmarshalBasicAuthSource(d *caddyfile.Dispenser) error {
+	var username string
+	if !d.Args(&username) {
+		return d.ArgErr()
+	}
+
+	source, err := unmarshalSecretSource(d)
+	if err != nil {
+		return d.Errf(`parsing basic_auth_source %w`, err)
+	}
+
+	t.BasicAuth = append(t.BasicAuth, basicAuthCred{Username: username, PasswordSourceRaw: source})
+
+	return nil
+}
+
 func (t *HTTP) unmarshalCircuitBreaker(d *caddyfile.Dispenser) error {
 	var ratio string
 	if !d.AllArgs(&ratio) {
@@ -478,4 +550,5 @@ var (
 	_ Tunnel                = (*HTTP)(nil)
 	_ caddy.Provisioner     = (*HTTP)(nil)
 	_ caddyfile.Unmarshaler = (*HTTP)(nil)
+	_ secretHolder          = (*HTTP)(nil)
 )
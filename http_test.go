@@ -56,7 +56,7 @@ func TestHTTPBasicAuth(t *testing.T) {
 			}`,
 			expectConfig: func(t *testing.T, actual *HTTP) {
 				expected := []basicAuthCred{
-					{"foo", "barbarbar"},
+					{Username: "foo", Password: "barbarbar"},
 				}
 
 				require.Equal(t, expected, actual.BasicAuth)
@@ -74,7 +74,7 @@ func TestHTTPBasicAuth(t *testing.T) {
 			}`,
 			expectConfig: func(t *testing.T, actual *HTTP) {
 				expected := []basicAuthCred{
-					{"foo", "barbarbar"},
+					{Username: "foo", Password: "barbarbar"},
 				}
 
 				require.Equal(t, expected, actual.BasicAuth)
@@ -95,10 +95,10 @@ func TestHTTPBasicAuth(t *testing.T) {
 			}`,
 			expectConfig: func(t *testing.T, actual *HTTP) {
 				expected := []basicAuthCred{
-					{"foo", "barbarbar"},
-					{"spam", "eggsandcheese"},
-					{"bar", "bazbazbaz"},
-					{"bam", "bambinos"},
+					{Username: "foo", Password: "barbarbar"},
+					{Username: "spam", Password: "eggsandcheese"},
+					{Username: "bar", Password: "bazbazbaz"},
+					{Username: "bam", Password: "bambinos"},
 				}
 
 				require.Equal(t, expected, actual.BasicAuth)
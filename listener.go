@@ -0,0 +1,464 @@
+package ngroklistener
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.ngrok.com/ngrok"
+	"golang.ngrok.com/ngrok/config"
+)
+
+// tunnels holds the open ngrok tunnels, keyed by the fingerprints of their
+// session and tunnel config. A config reload that leaves a tunnel unchanged
+// picks up the open tunnel instead of opening a new one, so its URL survives
+// and in-flight connections are not cut.
+var tunnels = caddy.NewUsagePool()
+
+// pooledTunnel is an open ngrok tunnel shared across config reloads. A single
+// goroutine accepts connections from the tunnel and hands each one to whichever
+// listener is currently accepting. The underlying ngrok tunnel is replaced
+// when its session restarts; listeners keep accepting from the new one.
+type pooledTunnel struct {
+	key  string
+	sess *session
+	cfg  config.Tunnel
+
+	conns chan net.Conn
+
+	mu sync.Mutex
+
+	// the current ngrok tunnel; changed is closed when it is replaced
+	tun     ngrok.Tunnel
+	changed chan struct{}
+
+	// the config context of the listener wrapper currently using this tunnel
+	owner <-chan struct{}
+
+	// how long to wait for open connections when the tunnel is closed
+	drainTimeout time.Duration
+
+	// the name of the Caddy server currently using this tunnel, if known
+	server string
+
+	// the last ngrok tunnel closed by closeTunnel, whose accept errors are
+	// expected
+	closed ngrok.Tunnel
+
+	// the last ngrok tunnel that stopped accepting connections
+	down ngrok.Tunnel
+
+	// connections accepted from the tunnel that are still open; idle is
+	// closed whenever the last of them closes
+	active map[*trackedConn]struct{}
+	idle   chan struct{}
+
+	destructOnce sync.Once
+	done         chan struct{}
+}
+
+func newPooledTunnel(key string, sess *session, cfg config.Tunnel, tun ngrok.Tunnel) *pooledTunnel {
+	initMetrics()
+
+	pt := &pooledTunnel{
+		key:     key,
+		sess:    sess,
+		cfg:     cfg,
+		conns:   make(chan net.Conn),
+		tun:     tun,
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+		active:  make(map[*trackedConn]struct{}),
+	}
+
+	go pt.acceptLoop()
+
+	return pt
+}
+
+func (pt *pooledTunnel) acceptLoop() {
+	for {
+		tun, changed := pt.current()
+
+		if tun != nil {
+			conn, err := tun.Accept()
+			if err == nil {
+				tracked := pt.track(conn)
+
+				select {
+				case pt.conns <- tracked:
+				case <-pt.done:
+					_ = tracked.Close()
+					return
+				}
+
+				continue
+			}
+
+			pt.markDown(tun)
+
+			if !pt.closedByUs(tun) {
+				pt.acceptFailed()
+			}
+		}
+
+		// the tunnel was closed; wait for its session to replace it
+		select {
+		case <-changed:
+		case <-pt.done:
+			return
+		}
+	}
+}
+
+// current returns the current ngrok tunnel, and a channel closed when it is
+// replaced.
+func (pt *pooledTunnel) current() (ngrok.Tunnel, <-chan struct{}) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	return pt.tun, pt.changed
+}
+
+// markDown records that tun stopped accepting connections.
+func (pt *pooledTunnel) markDown(tun ngrok.Tunnel) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	pt.down = tun
+}
+
+// up reports whether the current ngrok tunnel is accepting connections.
+func (pt *pooledTunnel) up() bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	return pt.tun != nil && pt.tun != pt.down
+}
+
+// replace swaps in a new ngrok tunnel opened with the same config.
+func (pt *pooledTunnel) replace(tun ngrok.Tunnel) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	pt.tun = tun
+	close(pt.changed)
+	pt.changed = make(chan struct{})
+}
+
+// Addr returns the address of the current ngrok tunnel.
+func (pt *pooledTunnel) Addr() net.Addr {
+	tun, _ := pt.current()
+
+	return tun.Addr()
+}
+
+// closeTunnel closes the current ngrok tunnel, so the ngrok edge stops routing
+// new connections to it. Connections already accepted are left open.
+func (pt *pooledTunnel) closeTunnel() error {
+	pt.mu.Lock()
+	tun := pt.tun
+	pt.closed = tun
+	pt.mu.Unlock()
+
+	if tun == nil {
+		return nil
+	}
+
+	return tun.Close()
+}
+
+// closedByUs reports whether tun was closed by closeTunnel, rather than
+// failing.
+func (pt *pooledTunnel) closedByUs(tun ngrok.Tunnel) bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	return pt.closed == tun
+}
+
+func (pt *pooledTunnel) track(conn net.Conn) *trackedConn {
+	tracked := &trackedConn{Conn: conn, tunnel: pt, metrics: pt.connAccepted()}
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if len(pt.active) == 0 {
+		pt.idle = make(chan struct{})
+	}
+	pt.active[tracked] = struct{}{}
+
+	return tracked
+}
+
+func (pt *pooledTunnel) untrack(conn *trackedConn) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if _, ok := pt.active[conn]; !ok {
+		return
+	}
+
+	delete(pt.active, conn)
+	if len(pt.active) == 0 {
+		close(pt.idle)
+	}
+}
+
+func (pt *pooledTunnel) setDrainTimeout(timeout time.Duration) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	pt.drainTimeout = timeout
+}
+
+func (pt *pooledTunnel) setServer(name string) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	pt.server = name
+}
+
+func (pt *pooledTunnel) serverName() string {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	return pt.server
+}
+
+// drain waits for the connections accepted from the tunnel to close, up to
+// the drain timeout, and then closes any that are left.
+func (pt *pooledTunnel) drain() {
+	pt.mu.Lock()
+	if len(pt.active) == 0 {
+		pt.mu.Unlock()
+		return
+	}
+	idle, timeout := pt.idle, pt.drainTimeout
+	pt.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-idle:
+		return
+	case <-timer.C:
+	}
+
+	pt.mu.Lock()
+	remaining := make([]*trackedConn, 0, len(pt.active))
+	for conn := range pt.active {
+		remaining = append(remaining, conn)
+	}
+	pt.mu.Unlock()
+
+	for _, conn := range remaining {
+		_ = conn.Close()
+	}
+}
+
+// claim marks the tunnel as used by the config whose context is owner. It
+// reports false if a wrapper of that config already uses it, which happens
+// when one config has several identical tunnels.
+func (pt *pooledTunnel) claim(owner <-chan struct{}) bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if pt.owner == owner {
+		return false
+	}
+
+	pt.owner = owner
+
+	return true
+}
+
+// Destruct implements caddy.Destructor. The tunnel is closed so the ngrok edge
+// stops routing new connections to it; the connections already accepted are
+// drained by whoever released it, once all the tunnels it releases are closed.
+func (pt *pooledTunnel) Destruct() error {
+	pt.destructOnce.Do(func() { close(pt.done) })
+
+	pt.sess.forget(pt)
+
+	return pt.closeTunnel()
+}
+
+// drainTunnels drains the tunnels together, so closing several of them takes
+// at most one drain timeout.
+func drainTunnels(pts []*pooledTunnel) {
+	var wg sync.WaitGroup
+	for _, pt := range pts {
+		wg.Add(1)
+		go func(pt *pooledTunnel) {
+			defer wg.Done()
+			pt.drain()
+		}(pt)
+	}
+	wg.Wait()
+}
+
+// loadTunnel returns a pooled tunnel for cfg on sess that is not yet used by
+// the config of ctx, opening a new one if there is none. Every successful call
+// must be paired with a call to releaseTunnel with the returned tunnel's key.
+func loadTunnel(ctx caddy.Context, sess *session, fingerprint string, cfg config.Tunnel) (pt *pooledTunnel, loaded bool, err error) {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("%s/%s/%d", sess.key, fingerprint, i)
+
+		val, loaded, err := tunnels.LoadOrNew(key, func() (caddy.Destructor, error) {
+			return sess.listen(key, cfg)
+		})
+		if err != nil {
+			return nil, false, err
+		}
+
+		pt := val.(*pooledTunnel)
+		if pt.claim(ctx.Done()) {
+			return pt, loaded, nil
+		}
+
+		closed, err := releaseTunnel(key)
+		if closed {
+			pt.drain()
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// releaseTunnel drops a reference to the pooled tunnel for key, closing it if
+// it was the last one. It reports whether the tunnel was closed, in which case
+// the caller drains it.
+func releaseTunnel(key string) (closed bool, err error) {
+	return tunnels.Delete(key)
+}
+
+// trackedConn is a connection accepted from a pooled tunnel, tracked so that
+// closing the tunnel can wait for it.
+type trackedConn struct {
+	net.Conn
+
+	tunnel    *pooledTunnel
+	closeOnce sync.Once
+
+	// the metrics of the connection, if it was accepted from the tunnel
+	metrics *connMetrics
+}
+
+// Read implements net.Conn
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.metrics != nil {
+		c.metrics.received.Add(float64(n))
+	}
+
+	return n, err
+}
+
+// Write implements net.Conn
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if c.metrics != nil {
+		c.metrics.sent.Add(float64(n))
+	}
+
+	return n, err
+}
+
+// Close implements net.Conn
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+
+	c.closeOnce.Do(func() {
+		c.tunnel.untrack(c)
+
+		if c.metrics != nil {
+			c.metrics.active.Dec()
+		}
+	})
+
+	return err
+}
+
+// tunnelListener is the net.Listener handed to Caddy for a pooled tunnel.
+// Closing it only stops this listener from accepting; the tunnel itself stays
+// open until its last reference is released.
+type tunnelListener struct {
+	*pooledTunnel
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newTunnelListener(pt *pooledTunnel) *tunnelListener {
+	return &tunnelListener{
+		pooledTunnel: pt,
+		closed:       make(chan struct{}),
+	}
+}
+
+// Accept implements net.Listener
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	// a closed listener must not take a connection another listener of the
+	// tunnel would serve
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-l.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener
+func (l *tunnelListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+// tunnelFingerprint identifies the type and options of a provisioned tunnel.
+func tunnelFingerprint(t Tunnel) string {
+	var id caddy.ModuleID
+	if mod, ok := t.(caddy.Module); ok {
+		id = mod.CaddyModule().ID
+	}
+
+	// resolved secrets are left out of the tunnel's JSON; a rotated one must
+	// still open a new tunnel
+	var secrets []string
+	if holder, ok := t.(secretHolder); ok {
+		secrets = holder.secrets()
+	}
+
+	return fingerprint(struct {
+		Type    caddy.ModuleID
+		Tunnel  Tunnel
+		Secrets []string `json:",omitempty"`
+	}{id, t, secrets})
+}
+
+// fingerprint returns a stable digest of the JSON encoding of v. Modules are
+// fingerprinted after provisioning so placeholders are already resolved.
+func fingerprint(v any) string {
+	h := sha256.New()
+
+	_ = json.NewEncoder(h).Encode(v)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
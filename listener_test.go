@@ -0,0 +1,246 @@
+package ngroklistener
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTunnelOf returns the fake ngrok tunnel behind a provisioned wrapper.
+func fakeTunnelOf(t *testing.T, n *Ngrok) *fakeTunnel {
+	t.Helper()
+
+	current, _ := n.pooled[0].current()
+	tun, ok := current.(*fakeTunnel)
+	require.True(t, ok)
+
+	return tun
+}
+
+// acceptOne dials the fake tunnel and accepts the connection on ln.
+func acceptOne(t *testing.T, tun *fakeTunnel, ln net.Listener) net.Conn {
+	t.Helper()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		require.Nil(t, err)
+		accepted <- conn
+	}()
+
+	client, err := tun.dial()
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	return <-accepted
+}
+
+func TestTunnelReusedAcrossReload(t *testing.T) {
+	input := `ngrok {
+		tunnel http {
+			domain reload.example.com
+		}
+	}`
+
+	old := provisionNgrok(t, input)
+	oldListener := old.WrapListener(nil)
+
+	current := provisionNgrok(t, input)
+	require.Same(t, old.pooled[0], current.pooled[0])
+
+	// the old server stops before its config is cleaned up
+	require.Nil(t, oldListener.Close())
+	_, err := oldListener.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	require.Nil(t, old.Cleanup())
+
+	tun := fakeTunnelOf(t, current)
+	require.False(t, tun.isClosed())
+
+	conn := acceptOne(t, tun, current.WrapListener(nil))
+	require.Nil(t, conn.Close())
+
+	require.Nil(t, current.Cleanup())
+	require.True(t, tun.isClosed())
+}
+
+func TestTunnelRecreatedWhenChanged(t *testing.T) {
+	old := provisionNgrok(t, `ngrok {
+		tunnel http {
+			domain old.example.com
+		}
+	}`)
+	current := provisionNgrok(t, `ngrok {
+		tunnel http {
+			domain new.example.com
+		}
+	}`)
+	require.NotSame(t, old.pooled[0], current.pooled[0])
+
+	oldTunnel := fakeTunnelOf(t, old)
+	require.Nil(t, old.Cleanup())
+	require.True(t, oldTunnel.isClosed())
+	require.False(t, fakeTunnelOf(t, current).isClosed())
+
+	require.Nil(t, current.Cleanup())
+}
+
+func TestIdenticalTunnelsInOneConfig(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	input := `ngrok {
+		tunnel tcp
+	}`
+
+	first := provisionNgrokIn(t, ctx, input)
+	second := provisionNgrokIn(t, ctx, input)
+	require.NotSame(t, first.pooled[0], second.pooled[0])
+
+	// a reload of the same config picks up both tunnels
+	reloadCtx, reloadCancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer reloadCancel()
+
+	reloadedFirst := provisionNgrokIn(t, reloadCtx, input)
+	reloadedSecond := provisionNgrokIn(t, reloadCtx, input)
+	require.ElementsMatch(t,
+		[]*pooledTunnel{first.pooled[0], second.pooled[0]},
+		[]*pooledTunnel{reloadedFirst.pooled[0], reloadedSecond.pooled[0]},
+	)
+
+	for _, n := range []*Ngrok{first, second, reloadedFirst, reloadedSecond} {
+		require.Nil(t, n.Cleanup())
+	}
+}
+
+func TestTunnelFingerprint(t *testing.T) {
+	require.NotEqual(t, tunnelFingerprint(&HTTP{}), tunnelFingerprint(&TCP{}))
+	require.Equal(t,
+		tunnelFingerprint(&HTTP{Domain: "a.example.com"}),
+		tunnelFingerprint(&HTTP{Domain: "a.example.com"}),
+	)
+	require.NotEqual(t,
+		tunnelFingerprint(&HTTP{Domain: "a.example.com"}),
+		tunnelFingerprint(&HTTP{Domain: "b.example.com"}),
+	)
+}
+
+func TestCleanupDrainsConnections(t *testing.T) {
+	n := provisionNgrok(t, `ngrok {
+		drain_timeout 1m
+	}`)
+	tun := fakeTunnelOf(t, n)
+	sess := tun.sess
+
+	conn := acceptOne(t, tun, n.WrapListener(nil))
+
+	cleanedUp := make(chan error)
+	go func() { cleanedUp <- n.Cleanup() }()
+
+	require.Eventually(t, tun.isClosed, time.Second, time.Millisecond)
+	require.False(t, sess.isClosed())
+
+	select {
+	case <-cleanedUp:
+		t.Fatal("cleanup returned before the connection was closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.Nil(t, conn.Close())
+	require.Nil(t, <-cleanedUp)
+	require.True(t, sess.isClosed())
+}
+
+func TestCleanupClosesAllTunnelsBeforeDraining(t *testing.T) {
+	n := provisionNgrok(t, `ngrok {
+		drain_timeout 1m
+		tunnel tcp
+		tunnel http
+	}`)
+	require.Len(t, n.pooled, 2)
+
+	ln := n.WrapListener(nil)
+
+	var (
+		tuns  []*fakeTunnel
+		conns []net.Conn
+	)
+	for _, pt := range n.pooled {
+		current, _ := pt.current()
+		tun, ok := current.(*fakeTunnel)
+		require.True(t, ok)
+
+		tuns = append(tuns, tun)
+		conns = append(conns, acceptOne(t, tun, ln))
+	}
+
+	cleanedUp := make(chan error)
+	go func() { cleanedUp <- n.Cleanup() }()
+
+	// every tunnel stops getting connections while the first one drains
+	for _, tun := range tuns {
+		require.Eventually(t, tun.isClosed, time.Second, time.Millisecond)
+	}
+
+	select {
+	case <-cleanedUp:
+		t.Fatal("cleanup returned before the connections were closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for _, conn := range conns {
+		require.Nil(t, conn.Close())
+	}
+	require.Nil(t, <-cleanedUp)
+}
+
+func TestCleanupDrainsTunnelsTogether(t *testing.T) {
+	n := provisionNgrok(t, `ngrok {
+		drain_timeout 200ms
+		tunnel tcp
+		tunnel http
+	}`)
+
+	ln := n.WrapListener(nil)
+	for _, pt := range n.pooled {
+		current, _ := pt.current()
+		acceptOne(t, current.(*fakeTunnel), ln)
+	}
+
+	start := time.Now()
+	require.Nil(t, n.Cleanup())
+	require.Less(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestCleanupDrainTimeout(t *testing.T) {
+	n := provisionNgrok(t, `ngrok {
+		drain_timeout 50ms
+	}`)
+	tun := fakeTunnelOf(t, n)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := n.WrapListener(nil).Accept()
+		require.Nil(t, err)
+		accepted <- conn
+	}()
+
+	client, err := tun.dial()
+	require.Nil(t, err)
+	defer client.Close()
+	<-accepted
+
+	start := time.Now()
+	require.Nil(t, n.Cleanup())
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	require.True(t, tun.sess.isClosed())
+
+	_, err = client.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
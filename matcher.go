@@ -0,0 +1,155 @@
+package ngroklistener
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(new(MatchNgrok))
+}
+
+// MatchNgrok matches requests that arrived through an ngrok tunnel, as opposed
+// to those served locally with keep_local or fallback. Requests can further be
+// matched by the tunnel they arrived on; each set field must match.
+type MatchNgrok struct {
+	// The IDs of the tunnels to match.
+	IDs []string `json:"ids,omitempty"`
+
+	// The types of the tunnels to match: http, tcp, tls or labeled.
+	Types []string `json:"types,omitempty"`
+
+	// The domains of the tunnels to match, compared to the host of the tunnel
+	// URL.
+	Domains []string `json:"domains,omitempty"`
+
+	// The labels the tunnel must have, with their values.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// CaddyModule implements caddy.Module
+func (*MatchNgrok) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.matchers.ngrok",
+		New: func() caddy.Module {
+			return new(MatchNgrok)
+		},
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (m *MatchNgrok) Provision(ctx caddy.Context) error {
+	for _, typ := range m.Types {
+		switch typ {
+		case "http", "tcp", "tls", "labeled":
+		default:
+			return fmt.Errorf("unrecognized tunnel type '%s'; must be one of http, tcp, tls, labeled", typ)
+		}
+	}
+
+	return nil
+}
+
+// Match implements caddyhttp.RequestMatcher
+func (m *MatchNgrok) Match(r *http.Request) bool {
+	info := requestConnInfo(r)
+	if info == nil {
+		return false
+	}
+
+	if len(m.IDs) > 0 && !slices.Contains(m.IDs, info.TunnelID) {
+		return false
+	}
+
+	if len(m.Types) > 0 && !slices.Contains(m.Types, info.TunnelType) {
+		return false
+	}
+
+	if len(m.Domains) > 0 && !m.matchDomain(info.TunnelURL) {
+		return false
+	}
+
+	for label, value := range m.Labels {
+		if actual, ok := info.Labels[label]; !ok || actual != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *MatchNgrok) matchDomain(tunnelURL string) bool {
+	u, err := url.Parse(tunnelURL)
+	if err != nil {
+		return false
+	}
+
+	for _, domain := range m.Domains {
+		if strings.EqualFold(u.Hostname(), domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *MatchNgrok) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			subdirective := d.Val()
+			switch subdirective {
+			case "id":
+				if d.CountRemainingArgs() == 0 {
+					return d.ArgErr()
+				}
+
+				m.IDs = append(m.IDs, d.RemainingArgs()...)
+			case "type":
+				if d.CountRemainingArgs() == 0 {
+					return d.ArgErr()
+				}
+
+				m.Types = append(m.Types, d.RemainingArgs()...)
+			case "domain":
+				if d.CountRemainingArgs() == 0 {
+					return d.ArgErr()
+				}
+
+				m.Domains = append(m.Domains, d.RemainingArgs()...)
+			case "label":
+				var label, value string
+				if !d.AllArgs(&label, &value) {
+					return d.ArgErr()
+				}
+
+				if m.Labels == nil {
+					m.Labels = map[string]string{}
+				}
+
+				m.Labels[label] = value
+			default:
+				return d.Errf("unrecognized subdirective %s", subdirective)
+			}
+		}
+	}
+
+	return nil
+}
+
+var (
+	_ caddy.Module             = (*MatchNgrok)(nil)
+	_ caddy.Provisioner        = (*MatchNgrok)(nil)
+	_ caddyhttp.RequestMatcher = (*MatchNgrok)(nil)
+	_ caddyfile.Unmarshaler    = (*MatchNgrok)(nil)
+)
@@ -0,0 +1,157 @@
+package ngroklistener
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMatchNgrok(t *testing.T) {
+	cases := genericNgrokTestCases[*MatchNgrok]{
+		{
+			name:       "default",
+			caddyInput: `ngrok`,
+			expectConfig: func(t *testing.T, actual *MatchNgrok) {
+				require.Equal(t, &MatchNgrok{}, actual)
+			},
+		},
+		{
+			name: "all subdirectives",
+			caddyInput: `ngrok {
+				id tn_1 tn_2
+				type http tls
+				domain a.example.com
+				domain b.example.com
+				label edge edghts_1
+				label team web
+			}`,
+			expectConfig: func(t *testing.T, actual *MatchNgrok) {
+				require.Equal(t, &MatchNgrok{
+					IDs:     []string{"tn_1", "tn_2"},
+					Types:   []string{"http", "tls"},
+					Domains: []string{"a.example.com", "b.example.com"},
+					Labels:  map[string]string{"edge": "edghts_1", "team": "web"},
+				}, actual)
+			},
+		},
+		{
+			name:               "takes no args",
+			caddyInput:         `ngrok arg1`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "id requires an arg",
+			caddyInput: `ngrok {
+				id
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "label requires a value",
+			caddyInput: `ngrok {
+				label edge
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "unsupported directive",
+			caddyInput: `ngrok {
+				directive
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "unknown type",
+			caddyInput: `ngrok {
+				type udp
+			}`,
+			expectConfig:       func(t *testing.T, actual *MatchNgrok) {},
+			expectProvisionErr: true,
+		},
+	}
+
+	cases.runAll(t)
+}
+
+func TestMatchNgrok(t *testing.T) {
+	tunneled := &connInfo{
+		TunnelID:   "tn_1",
+		TunnelURL:  "https://Public.example.com",
+		TunnelType: "http",
+		Labels:     map[string]string{"team": "web"},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		matcher MatchNgrok
+		info    *connInfo
+		expect  bool
+	}{
+		{name: "local request", matcher: MatchNgrok{}, info: nil, expect: false},
+		{name: "tunneled request", matcher: MatchNgrok{}, info: tunneled, expect: true},
+		{name: "id", matcher: MatchNgrok{IDs: []string{"tn_0", "tn_1"}}, info: tunneled, expect: true},
+		{name: "other id", matcher: MatchNgrok{IDs: []string{"tn_0"}}, info: tunneled, expect: false},
+		{name: "type", matcher: MatchNgrok{Types: []string{"http"}}, info: tunneled, expect: true},
+		{name: "other type", matcher: MatchNgrok{Types: []string{"tcp", "labeled"}}, info: tunneled, expect: false},
+		{name: "domain", matcher: MatchNgrok{Domains: []string{"public.example.com"}}, info: tunneled, expect: true},
+		{name: "other domain", matcher: MatchNgrok{Domains: []string{"example.com"}}, info: tunneled, expect: false},
+		{name: "label", matcher: MatchNgrok{Labels: map[string]string{"team": "web"}}, info: tunneled, expect: true},
+		{name: "other label value", matcher: MatchNgrok{Labels: map[string]string{"team": "api"}}, info: tunneled, expect: false},
+		{name: "missing label", matcher: MatchNgrok{Labels: map[string]string{"edge": "edghts_1"}}, info: tunneled, expect: false},
+		{
+			name:    "all fields",
+			matcher: MatchNgrok{IDs: []string{"tn_1"}, Types: []string{"http"}, Domains: []string{"public.example.com"}},
+			info:    tunneled,
+			expect:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tc.info != nil {
+				r = r.WithContext(context.WithValue(r.Context(), connInfoCtxKey, tc.info))
+			}
+
+			require.Equal(t, tc.expect, tc.matcher.Match(r))
+		})
+	}
+}
+
+func TestMatchNgrokRoutes(t *testing.T) {
+	dir := t.TempDir()
+	runCaddy(t, fmt.Sprintf(`{
+	"admin": {"disabled": true},
+	"apps": {
+		"http": {
+			"servers": {
+				"matcher": {
+					"listen": ["unix/%s/matcher.sock"],
+					"listener_wrappers": [{
+						"wrapper": "ngrok",
+						"auth_token": "matcher-test",
+						"keep_local": true,
+						"tunnels": [{"type": "http", "domain": "public.example.com"}]
+					}],
+					"routes": [
+						{"match": [{"ngrok": {"types": ["http"]}}], "handle": [{"handler": "static_response", "body": "public"}], "terminal": true},
+						{"handle": [{"handler": "static_response", "body": "local"}]}
+					]
+				}
+			}
+		}
+	}
+}`, dir))
+
+	tun, _ := serverTunnel("matcher").current()
+
+	client, err := tun.(*fakeTunnel).dial()
+	require.Nil(t, err)
+	require.Equal(t, "public", httpGet(t, client))
+
+	local, err := net.Dial("unix", dir+"/matcher.sock")
+	require.Nil(t, err)
+	require.Equal(t, "local", httpGet(t, local))
+}
@@ -0,0 +1,168 @@
+package ngroklistener
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Connection sources, as reported by the Source method of the connections
+// returned from a listener wrapped by ngrok.
+const (
+	sourceLocal = "local"
+	sourceNgrok = "ngrok"
+)
+
+// sourcedConn is implemented by connections that know which listener they
+// were accepted from.
+type sourcedConn interface {
+	net.Conn
+	Source() string
+}
+
+// Source implements sourcedConn
+func (*trackedConn) Source() string { return sourceNgrok }
+
+// localConn is a connection accepted from the listener Caddy passed to
+// WrapListener.
+type localConn struct {
+	net.Conn
+}
+
+// Source implements sourcedConn
+func (localConn) Source() string { return sourceLocal }
+
+// localListener tags the connections of the listener Caddy passed to
+// WrapListener as local.
+type localListener struct {
+	net.Listener
+}
+
+// Accept implements net.Listener
+func (l localListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return localConn{conn}, nil
+}
+
+// mergedListener accepts connections from several listeners at once. Closing
+// it closes all of them. The address reported is that of the first listener.
+// A failing listener is retried with a backoff, so it does not stop the others
+// from serving; the merged listener only reports being closed once all of them
+// are.
+type mergedListener struct {
+	listeners []net.Listener
+
+	conns chan net.Conn
+
+	// closed once every listener is closed
+	drained chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// mergedAcceptBackoffMin and mergedAcceptBackoffMax bound the delay before
+// accepting again from a listener that failed, as net/http does for temporary
+// errors.
+const (
+	mergedAcceptBackoffMin = 5 * time.Millisecond
+	mergedAcceptBackoffMax = time.Second
+)
+
+func newMergedListener(listeners ...net.Listener) *mergedListener {
+	ml := &mergedListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		drained:   make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+
+	var wg sync.WaitGroup
+	for _, ln := range listeners {
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			ml.acceptLoop(ln)
+		}(ln)
+	}
+
+	go func() {
+		wg.Wait()
+		close(ml.drained)
+	}()
+
+	return ml
+}
+
+// acceptLoop hands the connections of ln to Accept until ln or the merged
+// listener is closed.
+func (ml *mergedListener) acceptLoop(ln net.Listener) {
+	failures := 0
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			timer := time.NewTimer(backoff(failures, mergedAcceptBackoffMin, mergedAcceptBackoffMax))
+			failures++
+
+			select {
+			case <-timer.C:
+				continue
+			case <-ml.closed:
+				timer.Stop()
+				return
+			}
+		}
+		failures = 0
+
+		select {
+		case ml.conns <- conn:
+		case <-ml.closed:
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// Accept implements net.Listener
+func (ml *mergedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ml.conns:
+		return conn, nil
+	case <-ml.drained:
+		return nil, net.ErrClosed
+	case <-ml.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener
+func (ml *mergedListener) Close() error {
+	var errs []error
+
+	ml.closeOnce.Do(func() {
+		close(ml.closed)
+
+		for _, ln := range ml.listeners {
+			if err := ln.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	})
+
+	return errors.Join(errs...)
+}
+
+// Addr implements net.Listener
+func (ml *mergedListener) Addr() net.Addr {
+	return ml.listeners[0].Addr()
+}
@@ -0,0 +1,186 @@
+package ngroklistener
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeepLocalServesBothListeners(t *testing.T) {
+	n := provisionNgrok(t, `ngrok {
+		keep_local
+	}`)
+	defer n.Cleanup()
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	ln := n.WrapListener(local)
+	defer ln.Close()
+	require.Equal(t, local.Addr(), ln.Addr())
+
+	client, err := net.Dial("tcp", local.Addr().String())
+	require.Nil(t, err)
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	require.Nil(t, err)
+	require.Equal(t, sourceLocal, conn.(sourcedConn).Source())
+	require.Nil(t, conn.Close())
+
+	conn = acceptOne(t, fakeTunnelOf(t, n), ln)
+	require.Equal(t, sourceNgrok, conn.(sourcedConn).Source())
+	require.Nil(t, conn.Close())
+}
+
+func TestMergedListenerClose(t *testing.T) {
+	n := provisionNgrok(t, `ngrok {
+		keep_local
+	}`)
+	defer n.Cleanup()
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	ln := n.WrapListener(local)
+	require.Nil(t, ln.Close())
+
+	_, err = ln.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	_, err = net.Dial("tcp", local.Addr().String())
+	require.NotNil(t, err)
+
+	// the tunnel stays open until the wrapper is cleaned up
+	require.False(t, fakeTunnelOf(t, n).isClosed())
+}
+
+func TestWithoutKeepLocal(t *testing.T) {
+	n := provisionNgrok(t, `ngrok {
+	}`)
+	defer n.Cleanup()
+
+	ln := n.WrapListener(nil)
+	defer ln.Close()
+
+	conn := acceptOne(t, fakeTunnelOf(t, n), ln)
+	require.Equal(t, sourceNgrok, conn.(sourcedConn).Source())
+	require.Nil(t, conn.Close())
+}
+
+func TestMultipleTunnelsMerged(t *testing.T) {
+	n := provisionNgrok(t, `ngrok {
+		tunnel http
+		tunnel tcp
+		tunnel labeled {
+			label edge edghts_123
+		}
+	}`)
+	require.Len(t, n.pooled, 3)
+
+	var fakes []*fakeTunnel
+	for _, pt := range n.pooled {
+		tun, _ := pt.current()
+		fakes = append(fakes, tun.(*fakeTunnel))
+	}
+	require.Same(t, fakes[0].sess, fakes[1].sess)
+	require.Same(t, fakes[0].sess, fakes[2].sess)
+
+	ln := n.WrapListener(nil)
+	for _, tun := range fakes {
+		conn := acceptOne(t, tun, ln)
+		require.Nil(t, conn.Close())
+	}
+
+	require.Nil(t, ln.Close())
+	_, err := ln.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	require.Nil(t, n.Cleanup())
+	for _, tun := range fakes {
+		require.True(t, tun.isClosed())
+	}
+}
+
+// flakyListener fails its first Accept with a temporary error, then accepts
+// the connections of its channel.
+type flakyListener struct {
+	net.Listener
+
+	failed atomic.Bool
+	conns  chan net.Conn
+	closed chan struct{}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if !l.failed.Swap(true) {
+		return nil, temporaryError{}
+	}
+
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *flakyListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func TestMergedListenerRetriesFailedAccept(t *testing.T) {
+	flaky := &flakyListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+	other := &flakyListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+	other.failed.Store(true)
+
+	ml := newMergedListener(flaky, other)
+
+	// the failure is not reported, and the listener is accepted from again
+	server, client := net.Pipe()
+	defer client.Close()
+	flaky.conns <- server
+
+	conn, err := ml.Accept()
+	require.Nil(t, err)
+	require.Equal(t, server, conn)
+
+	require.Nil(t, ml.Close())
+
+	_, err = ml.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestMergedListenerClosedWithListeners(t *testing.T) {
+	first := &flakyListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+	second := &flakyListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+	first.failed.Store(true)
+	second.failed.Store(true)
+
+	ml := newMergedListener(first, second)
+
+	// one closed listener does not stop the other
+	require.Nil(t, first.Close())
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() { second.conns <- server }()
+
+	conn, err := ml.Accept()
+	require.Nil(t, err)
+	require.Equal(t, server, conn)
+
+	require.Nil(t, second.Close())
+
+	_, err = ml.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+}
@@ -0,0 +1,150 @@
+package ngroklistener
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var ngrokMetrics = struct {
+	init sync.Once
+
+	connectionsAccepted *prometheus.CounterVec
+	connectionsActive   *prometheus.GaugeVec
+	bytesReceived       *prometheus.CounterVec
+	bytesSent           *prometheus.CounterVec
+	acceptErrors        *prometheus.CounterVec
+
+	sessionReconnects       *prometheus.CounterVec
+	sessionConnected        *prometheus.GaugeVec
+	sessionHeartbeatLatency *prometheus.HistogramVec
+}{
+	init: sync.Once{},
+}
+
+// initMetrics registers the ngrok metrics in Caddy's metrics registry, which
+// is Prometheus' default one.
+func initMetrics() {
+	ngrokMetrics.init.Do(func() {
+		const ns, sub = "caddy", "ngrok"
+
+		tunnelLabels := []string{"server", "tunnel_type", "domain"}
+		ngrokMetrics.connectionsAccepted = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "connections_accepted_total",
+			Help:      "Counter of connections accepted from ngrok tunnels.",
+		}, tunnelLabels)
+		ngrokMetrics.connectionsActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "connections_active",
+			Help:      "Number of open connections accepted from ngrok tunnels.",
+		}, tunnelLabels)
+		ngrokMetrics.bytesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "received_bytes_total",
+			Help:      "Counter of bytes read from the connections of ngrok tunnels.",
+		}, tunnelLabels)
+		ngrokMetrics.bytesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "sent_bytes_total",
+			Help:      "Counter of bytes written to the connections of ngrok tunnels.",
+		}, tunnelLabels)
+		ngrokMetrics.acceptErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "accept_errors_total",
+			Help:      "Counter of errors accepting connections from ngrok tunnels, other than those of tunnels being closed.",
+		}, tunnelLabels)
+
+		sessionLabels := []string{"server"}
+		ngrokMetrics.sessionReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "session_reconnects_total",
+			Help:      "Counter of reconnections of the ngrok session of a server.",
+		}, sessionLabels)
+		ngrokMetrics.sessionConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "session_connected",
+			Help:      "Whether the ngrok session of a server is connected (1) or not (0).",
+		}, sessionLabels)
+		ngrokMetrics.sessionHeartbeatLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "session_heartbeat_latency_seconds",
+			Help:      "Histogram of the heartbeat latencies of the ngrok session of a server.",
+			Buckets:   prometheus.DefBuckets,
+		}, sessionLabels)
+	})
+}
+
+// metricLabels returns the tunnel labels of the metrics of pt: the server
+// using it, its type and the domain of its current URL.
+func (pt *pooledTunnel) metricLabels() prometheus.Labels {
+	var domain string
+
+	if tun, _ := pt.current(); tun != nil {
+		if u, err := url.Parse(tun.URL()); err == nil {
+			domain = u.Hostname()
+		}
+	}
+
+	return prometheus.Labels{
+		"server":      pt.serverName(),
+		"tunnel_type": tunnelType(pt.cfg),
+		"domain":      domain,
+	}
+}
+
+// connMetrics are the metrics of a connection accepted from a tunnel.
+type connMetrics struct {
+	active   prometheus.Gauge
+	received prometheus.Counter
+	sent     prometheus.Counter
+}
+
+// connAccepted counts a connection accepted from pt, and returns the metrics
+// it updates while open.
+func (pt *pooledTunnel) connAccepted() *connMetrics {
+	labels := pt.metricLabels()
+
+	ngrokMetrics.connectionsAccepted.With(labels).Inc()
+
+	m := &connMetrics{
+		active:   ngrokMetrics.connectionsActive.With(labels),
+		received: ngrokMetrics.bytesReceived.With(labels),
+		sent:     ngrokMetrics.bytesSent.With(labels),
+	}
+	m.active.Inc()
+
+	return m
+}
+
+func (pt *pooledTunnel) acceptFailed() {
+	ngrokMetrics.acceptErrors.With(pt.metricLabels()).Inc()
+}
+
+func (n *Ngrok) metricSessionConnected(connected bool) {
+	var value float64
+	if connected {
+		value = 1
+	}
+
+	ngrokMetrics.sessionConnected.WithLabelValues(n.server).Set(value)
+}
+
+func (n *Ngrok) metricSessionReconnected() {
+	ngrokMetrics.sessionReconnects.WithLabelValues(n.server).Inc()
+}
+
+func (n *Ngrok) metricSessionHeartbeat(latency time.Duration) {
+	ngrokMetrics.sessionHeartbeatLatency.WithLabelValues(n.server).Observe(latency.Seconds())
+}
@@ -0,0 +1,123 @@
+package ngroklistener
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelMetrics(t *testing.T) {
+	n := provisionNgrok(t, `ngrok {
+		tunnel http {
+			domain metrics.example.com
+		}
+	}`)
+	defer n.Cleanup()
+
+	tun := fakeTunnelOf(t, n)
+	labels := n.pooled[0].metricLabels()
+	require.Equal(t, "", labels["server"])
+	require.Equal(t, "http", labels["tunnel_type"])
+	require.Equal(t, tun.ID()+".ngrok.example", labels["domain"])
+
+	acceptedTotal := ngrokMetrics.connectionsAccepted.With(labels)
+	active := ngrokMetrics.connectionsActive.With(labels)
+	received := ngrokMetrics.bytesReceived.With(labels)
+	sent := ngrokMetrics.bytesSent.With(labels)
+
+	ln := n.WrapListener(nil)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		require.Nil(t, err)
+		accepted <- conn
+	}()
+
+	client, err := tun.dial()
+	require.Nil(t, err)
+	defer client.Close()
+
+	conn := <-accepted
+	require.Equal(t, 1.0, testutil.ToFloat64(acceptedTotal))
+	require.Equal(t, 1.0, testutil.ToFloat64(active))
+
+	go func() { _, _ = client.Write([]byte("ping!")) }()
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	require.Nil(t, err)
+	require.Equal(t, 5.0, testutil.ToFloat64(received))
+
+	go func() { _, _ = io.ReadFull(client, make([]byte, 4)) }()
+	_, err = conn.Write([]byte("pong"))
+	require.Nil(t, err)
+	require.Equal(t, 4.0, testutil.ToFloat64(sent))
+
+	require.Nil(t, conn.Close())
+	require.Nil(t, conn.Close())
+	require.Equal(t, 0.0, testutil.ToFloat64(active))
+	require.Equal(t, 1.0, testutil.ToFloat64(acceptedTotal))
+}
+
+func TestAcceptErrorMetrics(t *testing.T) {
+	n := provisionNgrok(t, `ngrok {
+		tunnel tls {
+			domain accept-errors.example.com
+		}
+	}`)
+	defer n.Cleanup()
+
+	pt := n.pooled[0]
+	acceptErrors := ngrokMetrics.acceptErrors.With(pt.metricLabels())
+
+	// a tunnel that fails is counted
+	tun := fakeTunnelOf(t, n)
+	require.Nil(t, tun.Close())
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(acceptErrors) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// a tunnel closed by the listener is not
+	pt.replace(newFakeTunnel(tun.sess, tun.cfg))
+	acceptErrors = ngrokMetrics.acceptErrors.With(pt.metricLabels())
+	require.Nil(t, pt.closeTunnel())
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 0.0, testutil.ToFloat64(acceptErrors))
+}
+
+func TestSessionMetrics(t *testing.T) {
+	n := provisionNgrok(t, `ngrok`)
+	defer n.Cleanup()
+
+	connected := ngrokMetrics.sessionConnected.WithLabelValues("")
+	require.Equal(t, 1.0, testutil.ToFloat64(connected))
+
+	// counters and histograms are global; drop the series of the test so that
+	// later runs start from scratch
+	n.server = "session-metrics"
+	t.Cleanup(func() {
+		ngrokMetrics.sessionConnected.DeleteLabelValues(n.server)
+		ngrokMetrics.sessionReconnects.DeleteLabelValues(n.server)
+		ngrokMetrics.sessionHeartbeatLatency.DeleteLabelValues(n.server)
+	})
+	connected = ngrokMetrics.sessionConnected.WithLabelValues(n.server)
+	reconnects := ngrokMetrics.sessionReconnects.WithLabelValues(n.server)
+
+	n.sessionDisconnected(n.session, nil)
+	require.Equal(t, 0.0, testutil.ToFloat64(connected))
+
+	n.sessionConnected(n.session, true)
+	require.Equal(t, 1.0, testutil.ToFloat64(connected))
+	require.Equal(t, 1.0, testutil.ToFloat64(reconnects))
+
+	n.sessionHeartbeat(n.session, 20*time.Millisecond)
+	n.sessionHeartbeat(n.session, 40*time.Millisecond)
+	var m dto.Metric
+	require.Nil(t, ngrokMetrics.sessionHeartbeatLatency.WithLabelValues(n.server).(prometheus.Metric).Write(&m))
+	require.Equal(t, uint64(2), m.GetHistogram().GetSampleCount())
+	require.InDelta(t, 0.06, m.GetHistogram().GetSampleSum(), 1e-9)
+}
@@ -2,16 +2,222 @@ package ngroklistener
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.ngrok.com/ngrok"
 	"golang.ngrok.com/ngrok/config"
 )
 
+func TestMain(m *testing.M) {
+	connect = fakeConnect
+	os.Exit(m.Run())
+}
+
+// fakeConnect stands in for ngrok.Connect so that provisioning never dials the
+// real ngrok service.
+func fakeConnect(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error) {
+	return &fakeSession{}, nil
+}
+
+// provisionNgrok unmarshals and provisions an Ngrok listener wrapper in a
+// config of its own.
+func provisionNgrok(t *testing.T, caddyInput string) *Ngrok {
+	t.Helper()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	return provisionNgrokIn(t, ctx, caddyInput)
+}
+
+// provisionNgrokIn unmarshals and provisions an Ngrok listener wrapper as part
+// of the config of ctx.
+func provisionNgrokIn(t *testing.T, ctx caddy.Context, caddyInput string) *Ngrok {
+	t.Helper()
+
+	n := new(Ngrok)
+	require.Nil(t, n.UnmarshalCaddyfile(caddyfile.NewTestDispenser(caddyInput)))
+	require.Nil(t, n.Provision(ctx))
+
+	return n
+}
+
+// withConnect replaces connect for the duration of a test.
+func withConnect(t *testing.T, fn func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error)) {
+	t.Helper()
+	connect = fn
+	t.Cleanup(func() { connect = fakeConnect })
+}
+
+type fakeSession struct {
+	mu        sync.Mutex
+	tunnels   []*fakeTunnel
+	closed    bool
+	listenErr error
+}
+
+func (s *fakeSession) Listen(_ context.Context, cfg config.Tunnel) (ngrok.Tunnel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listenErr != nil {
+		return nil, s.listenErr
+	}
+
+	if s.closed {
+		return nil, errors.New("session closed")
+	}
+
+	tun := newFakeTunnel(s, cfg)
+	s.tunnels = append(s.tunnels, tun)
+
+	return tun, nil
+}
+
+func (s *fakeSession) Warnings() []error { return nil }
+
+func (s *fakeSession) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for _, tun := range s.tunnels {
+		_ = tun.Close()
+	}
+
+	return nil
+}
+
+func (s *fakeSession) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+var fakeTunnelIDs atomic.Int64
+
+type fakeTunnel struct {
+	sess   *fakeSession
+	cfg    config.Tunnel
+	id     string
+	conns  chan net.Conn
+	done   chan struct{}
+	closed sync.Once
+
+	// reported by the connections of the tunnel
+	edgeType       ngrok.EdgeType
+	passthroughTLS bool
+}
+
+func newFakeTunnel(sess *fakeSession, cfg config.Tunnel) *fakeTunnel {
+	return &fakeTunnel{
+		sess:  sess,
+		cfg:   cfg,
+		id:    fmt.Sprintf("tn_%d", fakeTunnelIDs.Add(1)),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// dial hands a new connection to whoever is accepting on the tunnel and
+// returns the client side of it.
+func (t *fakeTunnel) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case t.conns <- &fakeConn{Conn: server, tun: t}:
+		return client, nil
+	case <-t.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *fakeTunnel) isClosed() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *fakeTunnel) Accept() (net.Conn, error) {
+	select {
+	case conn := <-t.conns:
+		return conn, nil
+	case <-t.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *fakeTunnel) Close() error {
+	t.closed.Do(func() { close(t.done) })
+	return nil
+}
+
+func (t *fakeTunnel) CloseWithContext(context.Context) error { return t.Close() }
+
+func (t *fakeTunnel) Addr() net.Addr { return fakeAddr(t.URL()) }
+
+func (t *fakeTunnel) ForwardsTo() string { return "caddy" }
+
+func (t *fakeTunnel) ID() string { return t.id }
+
+func (t *fakeTunnel) Labels() map[string]string {
+	if cfg, ok := t.cfg.(interface{ Labels() map[string]string }); ok {
+		return cfg.Labels()
+	}
+	return nil
+}
+
+func (t *fakeTunnel) Metadata() string { return "" }
+
+func (t *fakeTunnel) Proto() string {
+	if cfg, ok := t.cfg.(interface{ Proto() string }); ok {
+		return cfg.Proto()
+	}
+	return ""
+}
+
+func (t *fakeTunnel) Session() ngrok.Session { return t.sess }
+
+func (t *fakeTunnel) URL() string {
+	if t.Proto() == "" {
+		return ""
+	}
+	return t.Proto() + "://" + t.id + ".ngrok.example"
+}
+
+// fakeConn is a connection accepted from a fake ngrok tunnel.
+type fakeConn struct {
+	net.Conn
+
+	tun *fakeTunnel
+}
+
+func (c *fakeConn) Proto() string { return c.tun.Proto() }
+
+func (c *fakeConn) EdgeType() ngrok.EdgeType { return c.tun.edgeType }
+
+func (c *fakeConn) PassthroughTLS() bool { return c.tun.passthroughTLS }
+
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "ngrok" }
+
+func (a fakeAddr) String() string { return string(a) }
+
 type TestConfig interface {
 	Provision(caddy.Context) error
 	UnmarshalCaddyfile(*caddyfile.Dispenser) error
@@ -111,6 +317,9 @@ func (gt genericNgrokTest[C]) run(t *testing.T) {
 			return
 		} else {
 			require.Nil(t, err)
+			if cu, ok := any(ngrok).(caddy.CleanerUpper); ok {
+				defer func() { require.Nil(t, cu.Cleanup()) }()
+			}
 			if gt.expectedOptsFunc != nil {
 				gt.expectedOptsFunc(t, ngrok)
 			}
@@ -0,0 +1,341 @@
+package ngroklistener
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// notifySignatureHeader carries the HMAC-SHA256 of the body of a notification,
+// keyed with the secret, as 'sha256=<hex digest>'.
+const notifySignatureHeader = "X-Ngrok-Listener-Signature-256"
+
+const defaultNotifyRetries = 5
+
+// Bounds of the delay between two notification attempts. Tests shorten them.
+var (
+	notifyBackoffMin = time.Second
+	notifyBackoffMax = 30 * time.Second
+)
+
+// notifyTimeout bounds each notification attempt.
+const notifyTimeout = 10 * time.Second
+
+// notifyEvents are the events posted to the notify webhook. The tunnels of a
+// session go down and come back up with it.
+var notifyEvents = map[string]bool{
+	eventTunnelStarted:       true,
+	eventTunnelStopped:       true,
+	eventTunnelURLChanged:    true,
+	eventSessionDisconnected: true,
+	eventSessionReconnected:  true,
+}
+
+// notify configures a webhook that is posted a JSON payload whenever a tunnel
+// starts, stops or changes URL, and whenever the session goes down or comes
+// back up.
+type notify struct {
+	// URL is the http or https URL to post to.
+	URL string `json:"url,omitempty"`
+
+	// Headers are added to each request.
+	Headers http.Header `json:"headers,omitempty"`
+
+	// Secret, if set or resolved from secret_source, signs each payload with
+	// HMAC-SHA256 in the X-Ngrok-Listener-Signature-256 header.
+	Secret string `json:"secret,omitempty"`
+
+	// SecretSourceRaw resolves the secret through a secret source module, as
+	// an alternative to secret.
+	SecretSourceRaw json.RawMessage `json:"secret_source,omitempty" caddy:"namespace=caddy.listeners.ngrok.secrets inline_key=source"`
+
+	// Retries is how many times a failed notification is retried, with
+	// exponential backoff. Defaults to 5.
+	Retries *int `json:"retries,omitempty"`
+
+	// the secret in use, resolved from its source if it has one
+	secret string
+
+	// closed once the config is cleaned up, to give up retrying
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// notification is the payload posted to the notify webhook. It describes
+// either the tunnel or the session of the event.
+type notification struct {
+	Event     string         `json:"event"`
+	Server    string         `json:"server,omitempty"`
+	Timestamp time.Time      `json:"timestamp"`
+	Tunnel    map[string]any `json:"tunnel,omitempty"`
+	Session   map[string]any `json:"session,omitempty"`
+}
+
+func (nt *notify) provision(ctx caddy.Context) error {
+	if nt == nil {
+		return nil
+	}
+
+	nt.secret = nt.Secret
+	secret, ok, err := loadSecret(ctx, nt, "SecretSourceRaw", nt.SecretSourceRaw, nt.Secret)
+	if err != nil {
+		return fmt.Errorf("secret_source: %v", err)
+	}
+	if ok {
+		nt.secret = secret
+	}
+
+	nt.done = make(chan struct{})
+
+	u, err := url.Parse(nt.URL)
+	if err != nil {
+		return fmt.Errorf("parsing url: %v", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL; got '%s'", nt.URL)
+	}
+
+	if nt.Retries != nil && *nt.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+
+	return nil
+}
+
+// close gives up retrying the notifications not delivered yet. Attempts
+// already made are left to finish.
+func (nt *notify) close() {
+	if nt == nil || nt.done == nil {
+		return
+	}
+
+	nt.closeOnce.Do(func() { close(nt.done) })
+}
+
+// closed reports whether close was called.
+func (nt *notify) closed() bool {
+	select {
+	case <-nt.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (nt *notify) retries() int {
+	if nt.Retries == nil {
+		return defaultNotifyRetries
+	}
+
+	return *nt.Retries
+}
+
+// notify posts the event to the notify webhook in the background, if it is
+// one the webhook is notified of.
+func (n *Ngrok) notify(event string, data map[string]any) {
+	if n.Notify == nil || !notifyEvents[event] {
+		return
+	}
+
+	note := notification{
+		Event:     event,
+		Server:    n.server,
+		Timestamp: time.Now().UTC(),
+	}
+	if strings.HasPrefix(event, "ngrok.session.") {
+		note.Session = data
+	} else {
+		note.Tunnel = data
+	}
+
+	body, err := json.Marshal(note)
+	if err != nil {
+		n.l.Error("encoding ngrok notification", zap.String("event", event), zap.Error(err))
+		return
+	}
+
+	go n.deliver(event, body)
+}
+
+// deliver posts body to the webhook, retrying failed attempts until the config
+// is cleaned up.
+func (n *Ngrok) deliver(event string, body []byte) {
+	retries := n.Notify.retries()
+
+	for attempt := 0; ; attempt++ {
+		retry, err := n.Notify.post(body)
+		if err == nil {
+			return
+		}
+
+		if !retry || attempt >= retries {
+			n.l.Error("notifying ngrok change failed", zap.String("event", event), zap.String("url", n.Notify.URL), zap.Error(err))
+			return
+		}
+
+		giveUp := func() {
+			n.l.Warn("notifying ngrok change given up; the config was unloaded", zap.String("event", event), zap.Error(err))
+		}
+
+		if n.Notify.closed() {
+			giveUp()
+			return
+		}
+
+		delay := backoff(attempt, notifyBackoffMin, notifyBackoffMax)
+		n.l.Warn("notifying ngrok change failed; retrying", zap.String("event", event), zap.Error(err), zap.Duration("retry_in", delay))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-n.Notify.done:
+			timer.Stop()
+			giveUp()
+			return
+		}
+	}
+}
+
+// post makes one attempt at posting body, reporting whether a failure is worth
+// retrying: network errors and 429 or 5xx responses are.
+func (nt *notify) post(body []byte) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, nt.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	for name, values := range nt.Headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if nt.secret != "" {
+		req.Header.Set(notifySignatureHeader, "sha256="+sign(nt.secret, body))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("unexpected response status %s", resp.Status)
+
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+// sign returns the hex encoded HMAC-SHA256 of body keyed with secret.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (nt *notify) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "url":
+			if !d.AllArgs(&nt.URL) {
+				return d.ArgErr()
+			}
+		case "secret":
+			if !d.AllArgs(&nt.Secret) {
+				return d.ArgErr()
+			}
+		case "secret_source":
+			source, err := unmarshalSecretSource(d)
+			if err != nil {
+				return d.Errf(`parsing secret_source %w`, err)
+			}
+
+			nt.SecretSourceRaw = source
+		case "retries":
+			if err := nt.unmarshalRetries(d); err != nil {
+				return err
+			}
+		case "headers":
+			if err := nt.unmarshalHeaders(d); err != nil {
+				return err
+			}
+		default:
+			return d.Errf("unrecognized subdirective %s", subdirective)
+		}
+	}
+
+	return nil
+}
+
+func (nt *notify) unmarshalRetries(d *caddyfile.Dispenser) error {
+	var retriesStr string
+	if !d.AllArgs(&retriesStr) {
+		return d.ArgErr()
+	}
+
+	retries, err := strconv.Atoi(retriesStr)
+	if err != nil {
+		return d.Errf("parsing retries: %v", err)
+	}
+
+	nt.Retries = &retries
+
+	return nil
+}
+
+func (nt *notify) unmarshalHeaders(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	if nt.Headers == nil {
+		nt.Headers = http.Header{}
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		name := d.Val()
+		values := d.RemainingArgs()
+		if len(values) == 0 {
+			return d.ArgErr()
+		}
+
+		for _, value := range values {
+			nt.Headers.Add(name, value)
+		}
+	}
+
+	return nil
+}
+
+var _ caddyfile.Unmarshaler = (*notify)(nil)
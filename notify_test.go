@@ -0,0 +1,339 @@
+package ngroklistener
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNgrokNotify(t *testing.T) {
+	cases := genericNgrokTestCases[*Ngrok]{
+		{
+			name: "default",
+			caddyInput: `ngrok {
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Nil(t, actual.Notify)
+			},
+		},
+		{
+			name: "notify",
+			caddyInput: `ngrok {
+				notify {
+					url http://127.0.0.1:9/hook
+					secret s3cret
+					retries 2
+					headers {
+						Authorization "Bearer token"
+						X-Team dev ops
+					}
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				retries := 2
+				require.Equal(t, &notify{
+					URL:    "http://127.0.0.1:9/hook",
+					Secret: "s3cret",
+					Headers: http.Header{
+						"Authorization": {"Bearer token"},
+						"X-Team":        {"dev", "ops"},
+					},
+					Retries: &retries,
+				}, actual.Notify)
+
+				// nothing listens on the discard port; do not retry
+				actual.Notify.Retries = new(int)
+			},
+		},
+		{
+			name: "notify no url",
+			caddyInput: `ngrok {
+				notify {
+					secret s3cret
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, &notify{Secret: "s3cret"}, actual.Notify)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "notify relative url",
+			caddyInput: `ngrok {
+				notify {
+					url /hook
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, "/hook", actual.Notify.URL)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "notify negative retries",
+			caddyInput: `ngrok {
+				notify {
+					url http://127.0.0.1:9/hook
+					retries -1
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, -1, *actual.Notify.Retries)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "notify with arg",
+			caddyInput: `ngrok {
+				notify http://127.0.0.1:9/hook
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "notify unknown subdirective",
+			caddyInput: `ngrok {
+				notify {
+					method PUT
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "notify retries-not-int",
+			caddyInput: `ngrok {
+				notify {
+					retries many
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "notify header-no-value",
+			caddyInput: `ngrok {
+				notify {
+					headers {
+						Authorization
+					}
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+	}
+	cases.runAll(t)
+}
+
+// webhookStub records the notifications posted to it, failing the first
+// failures of them.
+type webhookStub struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	failures int
+	attempts int
+	received []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhookStub(t *testing.T, failures int) *webhookStub {
+	t.Helper()
+
+	stub := &webhookStub{failures: failures}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+
+		stub.attempts++
+		if stub.attempts <= stub.failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		stub.received = append(stub.received, r)
+		stub.bodies = append(stub.bodies, body)
+	}))
+	t.Cleanup(stub.Close)
+
+	return stub
+}
+
+// notifications waits for count notifications and returns them.
+func (s *webhookStub) notifications(t *testing.T, count int) ([]notification, []*http.Request, [][]byte) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		return len(s.received) >= count
+	}, 5*time.Second, 10*time.Millisecond)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	notes := make([]notification, len(s.bodies))
+	for i, body := range s.bodies {
+		require.Nil(t, json.Unmarshal(body, &notes[i]))
+	}
+
+	return notes, s.received, s.bodies
+}
+
+// withNotifyBackoff shortens the delay between notification attempts.
+func withNotifyBackoff(t *testing.T) {
+	t.Helper()
+
+	minDelay, maxDelay := notifyBackoffMin, notifyBackoffMax
+	notifyBackoffMin, notifyBackoffMax = time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() { notifyBackoffMin, notifyBackoffMax = minDelay, maxDelay })
+}
+
+func TestNotify(t *testing.T) {
+	withNotifyBackoff(t)
+	stub := newWebhookStub(t, 2)
+
+	n := provisionNgrok(t, fmt.Sprintf(`ngrok {
+		tunnel tcp
+		notify {
+			url %s/hook
+			secret s3cret
+			headers {
+				X-Team dev
+			}
+		}
+	}`, stub.URL))
+
+	tun := fakeTunnelOf(t, n)
+
+	notes, reqs, bodies := stub.notifications(t, 1)
+	require.Equal(t, eventTunnelStarted, notes[0].Event)
+	require.Equal(t, tun.ID(), notes[0].Tunnel["tunnel_id"])
+	require.Equal(t, tun.URL(), notes[0].Tunnel["url"])
+	require.Equal(t, "application/json", reqs[0].Header.Get("Content-Type"))
+	require.Equal(t, "dev", reqs[0].Header.Get("X-Team"))
+	require.Equal(t, "sha256="+sign("s3cret", bodies[0]), reqs[0].Header.Get(notifySignatureHeader))
+
+	// the failures before it were retried
+	stub.mu.Lock()
+	require.Equal(t, 3, stub.attempts)
+	stub.mu.Unlock()
+
+	reopened := newFakeTunnel(tun.sess, tun.cfg)
+	n.pooled[0].replace(reopened)
+
+	notes, _, _ = stub.notifications(t, 2)
+	require.Equal(t, eventTunnelURLChanged, notes[1].Event)
+	require.Equal(t, reopened.URL(), notes[1].Tunnel["url"])
+	require.Equal(t, tun.URL(), notes[1].Tunnel["previous_url"])
+
+	require.Nil(t, n.Cleanup())
+
+	notes, _, _ = stub.notifications(t, 3)
+	require.Equal(t, eventTunnelStopped, notes[2].Event)
+	require.Equal(t, reopened.ID(), notes[2].Tunnel["tunnel_id"])
+}
+
+func TestNotifySessionDownAndUp(t *testing.T) {
+	stub := newWebhookStub(t, 0)
+
+	n := provisionNgrok(t, fmt.Sprintf(`ngrok {
+		tunnel tcp
+		notify {
+			url %s/hook
+		}
+	}`, stub.URL))
+	defer n.Cleanup()
+
+	stub.notifications(t, 1)
+
+	n.session.notify(func(o sessionObserver) { o.sessionDisconnected(n.session, errors.New("connection reset")) })
+	notes, _, _ := stub.notifications(t, 2)
+
+	n.session.notify(func(o sessionObserver) { o.sessionConnected(n.session, true) })
+	notes, _, _ = stub.notifications(t, 3)
+
+	// notifications are posted concurrently
+	byEvent := make(map[string]notification)
+	for _, note := range notes {
+		byEvent[note.Event] = note
+	}
+
+	down := byEvent[eventSessionDisconnected]
+	require.Nil(t, down.Tunnel)
+	require.Equal(t, n.session.id(), down.Session["session_id"])
+	require.Equal(t, "connection reset", down.Session["error"])
+
+	up := byEvent[eventSessionReconnected]
+	require.Equal(t, n.session.id(), up.Session["session_id"])
+}
+
+func TestNotifyRetriesStopOnCleanup(t *testing.T) {
+	withNotifyBackoff(t)
+	stub := newWebhookStub(t, 1000)
+
+	retries := 1000
+	n := provisionNgrok(t, fmt.Sprintf(`ngrok {
+		tunnel tcp
+		notify {
+			url %s/hook
+			retries %d
+		}
+	}`, stub.URL, retries))
+
+	attempts := func() int {
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+
+		return stub.attempts
+	}
+	require.Eventually(t, func() bool { return attempts() > 2 }, 5*time.Second, time.Millisecond)
+
+	require.Nil(t, n.Cleanup())
+
+	// an attempt may still be in flight
+	time.Sleep(50 * time.Millisecond)
+	after := attempts()
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, after, attempts())
+}
+
+func TestNotifyGivesUp(t *testing.T) {
+	withNotifyBackoff(t)
+	stub := newWebhookStub(t, 100)
+
+	retries := 2
+	nt := &notify{URL: stub.URL, Retries: &retries}
+
+	retry, err := nt.post([]byte(`{}`))
+	require.True(t, retry)
+	require.NotNil(t, err)
+
+	n := &Ngrok{Notify: nt, l: zap.NewNop()}
+	n.deliver(eventTunnelStarted, []byte(`{}`))
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	require.Equal(t, 1+1+retries, stub.attempts)
+}
+
+func TestNotifyClientError(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer stub.Close()
+
+	retry, err := (&notify{URL: stub.URL}).post([]byte(`{}`))
+	require.False(t, retry)
+	require.NotNil(t, err)
+}
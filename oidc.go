@@ -1,7 +1,9 @@
 package ngroklistener
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/caddyserver/caddy/v2"
@@ -13,17 +15,34 @@ type oidc struct {
 	opts []config.OIDCOption
 	opt  config.HTTPEndpointOption
 
-	IssuerURL    string   `json:"issuer_url,omitempty"`
-	ClientID     string   `json:"client_id,omitempty"`
-	ClientSecret string   `json:"client_secret,omitempty"`
+	// the client secret in use, resolved from its source if it has one
+	clientSecret string
+
+	IssuerURL    string `json:"issuer_url,omitempty"`
+	ClientID     string `json:"client_id,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+
+	// ClientSecretSourceRaw resolves the client secret through a secret
+	// source module, as an alternative to client_secret.
+	ClientSecretSourceRaw json.RawMessage `json:"client_secret_source,omitempty" caddy:"namespace=caddy.listeners.ngrok.secrets inline_key=source"`
+
 	AllowEmails  []string `json:"allow_emails,omitempty"`
 	AllowDomains []string `json:"allow_domains,omitempty"`
 	Scopes       []string `json:"scopes,omitempty"`
 }
 
-func (o *oidc) Provision(caddy.Context) error {
+func (o *oidc) Provision(ctx caddy.Context) error {
 	o.doReplace()
 
+	o.clientSecret = o.ClientSecret
+	secret, ok, err := loadSecret(ctx, o, "ClientSecretSourceRaw", o.ClientSecretSourceRaw, o.ClientSecret)
+	if err != nil {
+		return fmt.Errorf("oidc `client_secret_source`: %v", err)
+	}
+	if ok {
+		o.clientSecret = secret
+	}
+
 	if len(o.AllowEmails) > 0 {
 		o.opts = append(o.opts, config.WithAllowOIDCEmail(o.AllowEmails...))
 	}
@@ -44,11 +63,11 @@ func (o *oidc) Provision(caddy.Context) error {
 		return errors.New("oidc `client_id` cannot be empty string")
 	}
 
-	if strings.TrimSpace(o.ClientSecret) == "" {
+	if strings.TrimSpace(o.clientSecret) == "" {
 		return errors.New("oidc `client_secret` cannot be empty string")
 	}
 
-	o.opt = config.WithOIDC(o.IssuerURL, o.ClientID, o.ClientSecret, o.opts...)
+	o.opt = config.WithOIDC(o.IssuerURL, o.ClientID, o.clientSecret, o.opts...)
 
 	return nil
 }
@@ -97,6 +116,13 @@ func (o *oidc) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			if !d.AllArgs(&o.ClientSecret) {
 				return d.ArgErr()
 			}
+		case "client_secret_source":
+			source, err := unmarshalSecretSource(d)
+			if err != nil {
+				return d.Errf(`parsing client_secret_source %w`, err)
+			}
+
+			o.ClientSecretSourceRaw = source
 		case "scopes":
 			if err := o.unmarshalScopes(d); err != nil {
 				return err
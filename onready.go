@@ -0,0 +1,172 @@
+package ngroklistener
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// onReady configures hooks run when a tunnel's URL becomes available: once
+// its tunnels are open, and again whenever reconnecting gives a tunnel a new
+// URL. The path of the file and the command accept the placeholders {url},
+// {id} and {metadata} of the tunnel, and {index}, its position in the
+// tunnels of the wrapper.
+type onReady struct {
+	// WriteFile is the path of a file to write the URL, ID and metadata of the
+	// tunnel to, as JSON.
+	WriteFile string `json:"write_file,omitempty"`
+
+	// Exec is a command to run, with its arguments. Its output is only logged
+	// if it fails.
+	Exec []string `json:"exec,omitempty"`
+}
+
+// readyTunnel is written to the file of the write_file hook.
+type readyTunnel struct {
+	URL      string `json:"url"`
+	ID       string `json:"id"`
+	Metadata string `json:"metadata,omitempty"`
+}
+
+// watchTunnel follows the URL of pt, the tunnel at index, until the tunnel or
+// the wrapper's config is done. The on_ready hooks run for its first URL and
+// every new one, and a change of URL is emitted as an event.
+func (n *Ngrok) watchTunnel(pt *pooledTunnel, index int) {
+	var url string
+
+	for {
+		tun, changed := pt.current()
+		if tun != nil && tun.URL() != url {
+			if url != "" {
+				data := n.tunnelData(pt)
+				data["previous_url"] = url
+				n.emit(eventTunnelURLChanged, data)
+			}
+
+			url = tun.URL()
+
+			if n.OnReady != nil {
+				n.runReadyHooks(index, readyTunnel{
+					URL:      url,
+					ID:       tun.ID(),
+					Metadata: tun.Metadata(),
+				})
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-pt.done:
+			return
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+func (n *Ngrok) runReadyHooks(index int, tun readyTunnel) {
+	repl := caddy.NewReplacer()
+	repl.Set("url", tun.URL)
+	repl.Set("id", tun.ID)
+	repl.Set("metadata", tun.Metadata)
+	repl.Set("index", strconv.Itoa(index))
+
+	if n.OnReady.WriteFile != "" {
+		path := repl.ReplaceAll(n.OnReady.WriteFile, "")
+		if err := writeReadyFile(path, tun); err != nil {
+			n.l.Error("writing on_ready file", zap.String("path", path), zap.Error(err))
+		}
+	}
+
+	if len(n.OnReady.Exec) > 0 {
+		args := make([]string, len(n.OnReady.Exec))
+		for i, arg := range n.OnReady.Exec {
+			args[i] = repl.ReplaceAll(arg, "")
+		}
+
+		go func() {
+			out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+			if err != nil {
+				n.l.Error("running on_ready command", zap.Strings("command", args), zap.ByteString("output", out), zap.Error(err))
+			}
+		}()
+	}
+}
+
+// writeReadyFile writes tun to path through a temporary file, so readers never
+// see it partially written.
+func writeReadyFile(path string, tun readyTunnel) error {
+	data, err := json.Marshal(tun)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(0o644); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (o *onReady) validate() error {
+	if o == nil {
+		return nil
+	}
+
+	if o.WriteFile == "" && len(o.Exec) == 0 {
+		return fmt.Errorf("on_ready needs write_file or exec")
+	}
+
+	return nil
+}
+
+func (o *onReady) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "write_file":
+			if !d.AllArgs(&o.WriteFile) {
+				return d.ArgErr()
+			}
+		case "exec":
+			if d.CountRemainingArgs() == 0 {
+				return d.ArgErr()
+			}
+
+			o.Exec = d.RemainingArgs()
+		default:
+			return d.Errf("unrecognized subdirective %s", subdirective)
+		}
+	}
+
+	return nil
+}
+
+var _ caddyfile.Unmarshaler = (*onReady)(nil)
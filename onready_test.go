@@ -0,0 +1,158 @@
+package ngroklistener
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNgrokOnReady(t *testing.T) {
+	cases := genericNgrokTestCases[*Ngrok]{
+		{
+			name: "default",
+			caddyInput: `ngrok {
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Nil(t, actual.OnReady)
+			},
+		},
+		{
+			name: "on_ready",
+			caddyInput: `ngrok {
+				on_ready {
+					write_file /tmp/url.json
+					exec echo {url} {id}
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, &onReady{
+					WriteFile: "/tmp/url.json",
+					Exec:      []string{"echo", "{url}", "{id}"},
+				}, actual.OnReady)
+
+				// keep the hooks run by provisioning out of /tmp
+				actual.OnReady.WriteFile = filepath.Join(t.TempDir(), "url.json")
+			},
+		},
+		{
+			name: "on_ready empty",
+			caddyInput: `ngrok {
+				on_ready {
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, &onReady{}, actual.OnReady)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "on_ready with arg",
+			caddyInput: `ngrok {
+				on_ready /tmp/url.json
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "on_ready unknown subdirective",
+			caddyInput: `ngrok {
+				on_ready {
+					run ./notify.sh
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "on_ready write_file-no-arg",
+			caddyInput: `ngrok {
+				on_ready {
+					write_file
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "on_ready exec-no-arg",
+			caddyInput: `ngrok {
+				on_ready {
+					exec
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+	}
+	cases.runAll(t)
+}
+
+// readReadyFile waits for path to hold the tunnel with the given URL.
+func readReadyFile(t *testing.T, path, url string) readyTunnel {
+	t.Helper()
+
+	var tun readyTunnel
+	require.Eventually(t, func() bool {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return false
+		}
+
+		require.Nil(t, json.Unmarshal(data, &tun))
+
+		return tun.URL == url
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return tun
+}
+
+func TestOnReady(t *testing.T) {
+	dir := t.TempDir()
+
+	n := provisionNgrok(t, fmt.Sprintf(`ngrok {
+		tunnel tcp
+		on_ready {
+			write_file %s/url-{index}.json
+			exec sh -c "echo $0 > %s/exec-$1" {url} {index}
+		}
+	}`, dir, dir))
+	defer n.Cleanup()
+
+	tun := fakeTunnelOf(t, n)
+	ready := readReadyFile(t, filepath.Join(dir, "url-0.json"), tun.URL())
+	require.Equal(t, readyTunnel{URL: tun.URL(), ID: tun.ID()}, ready)
+
+	require.Eventually(t, func() bool {
+		data, _ := os.ReadFile(filepath.Join(dir, "exec-0"))
+		return string(data) == tun.URL()+"\n"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a tunnel reopened with a new URL fires the hooks again
+	reopened := newFakeTunnel(tun.sess, tun.cfg)
+	n.pooled[0].replace(reopened)
+
+	ready = readReadyFile(t, filepath.Join(dir, "url-0.json"), reopened.URL())
+	require.Equal(t, reopened.ID(), ready.ID)
+
+	require.Eventually(t, func() bool {
+		data, _ := os.ReadFile(filepath.Join(dir, "exec-0"))
+		return string(data) == reopened.URL()+"\n"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWriteReadyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "url.json")
+
+	require.Nil(t, writeReadyFile(path, readyTunnel{URL: "https://a.ngrok.example", ID: "tn_a", Metadata: "ci"}))
+
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.JSONEq(t, `{"url": "https://a.ngrok.example", "id": "tn_a", "metadata": "ci"}`, string(data))
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+
+	require.NotNil(t, writeReadyFile(filepath.Join(path, "missing", "url.json"), readyTunnel{}))
+}
@@ -0,0 +1,238 @@
+package ngroklistener
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(new(Placeholders))
+	httpcaddyfile.RegisterHandlerDirective("ngrok_placeholders", parsePlaceholders)
+}
+
+// Placeholders set for the requests of the servers wrapped by ngrok
+const (
+	// the URL and ID of the first tunnel of the named server
+	tunnelsPlaceholderPrefix = "ngrok.tunnels."
+
+	// the region of the session of the server, or of the most recently
+	// started one on servers not wrapped by ngrok
+	sessionRegionPlaceholder = "ngrok.session.region"
+
+	// the URL of the tunnel the request arrived on
+	requestTunnelURLPlaceholder = "http.ngrok.tunnel.url"
+)
+
+// placeholdersHandler sets the ngrok placeholders on the replacer of each
+// request. It is prepended to the routes of the server the listener wrapper
+// belongs to, so that all the handlers of the server can use them.
+type placeholdersHandler struct {
+	n *Ngrok
+}
+
+// placeholdersRoute returns the route that sets the ngrok placeholders.
+func placeholdersRoute(n *Ngrok) caddyhttp.Route {
+	return caddyhttp.Route{
+		Handlers: []caddyhttp.MiddlewareHandler{placeholdersHandler{n}},
+	}
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler
+func (h placeholdersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Map(func(key string) (any, bool) {
+			return h.n.placeholder(r, key)
+		})
+	}
+
+	return next.ServeHTTP(w, r)
+}
+
+// Placeholders sets the ngrok placeholders that do not depend on the tunnel a
+// request arrived on, {ngrok.tunnels.<server>.url}, {ngrok.tunnels.<server>.id}
+// and {ngrok.session.region}, for the requests of any server. It lets servers
+// not wrapped by ngrok, such as a local one redirecting to the public URL, use
+// them; servers wrapped by ngrok have them set already.
+type Placeholders struct {
+	// the name of the server the handler belongs to, if known
+	server string
+}
+
+// CaddyModule implements caddy.Module
+func (*Placeholders) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.ngrok_placeholders",
+		New: func() caddy.Module {
+			return new(Placeholders)
+		},
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (h *Placeholders) Provision(ctx caddy.Context) error {
+	if srv, ok := ctx.Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server); ok {
+		h.server = srv.Name()
+	}
+
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler
+func (h *Placeholders) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Map(func(key string) (any, bool) {
+			return globalPlaceholder(h.server, key)
+		})
+	}
+
+	return next.ServeHTTP(w, r)
+}
+
+func (h *Placeholders) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+func parsePlaceholders(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	p := new(Placeholders)
+	err := p.UnmarshalCaddyfile(h.Dispenser)
+	return p, err
+}
+
+// placeholder returns the value of an ngrok placeholder for request r.
+func (n *Ngrok) placeholder(r *http.Request, key string) (any, bool) {
+	if val, ok := connInfoPlaceholder(r, key); ok {
+		return val, true
+	}
+
+	return globalPlaceholder(n.server, key)
+}
+
+// globalPlaceholder returns the value of an ngrok placeholder that does not
+// depend on the request, for the requests of the named server.
+func globalPlaceholder(server, key string) (any, bool) {
+	if key == sessionRegionPlaceholder {
+		pt := sessionTunnel(server)
+		if pt == nil {
+			return "", true
+		}
+
+		return pt.sess.region(), true
+	}
+
+	if rest, ok := strings.CutPrefix(key, tunnelsPlaceholderPrefix); ok {
+		dot := strings.LastIndex(rest, ".")
+		if dot < 0 {
+			return nil, false
+		}
+
+		server, field := rest[:dot], rest[dot+1:]
+		if field != "url" && field != "id" {
+			return nil, false
+		}
+
+		pt := serverTunnel(server)
+		if pt == nil {
+			return "", true
+		}
+
+		tun, _ := pt.current()
+		if tun == nil {
+			return "", true
+		}
+
+		if field == "id" {
+			return tun.ID(), true
+		}
+
+		return tun.URL(), true
+	}
+
+	return nil, false
+}
+
+// serverTunnel returns the first tunnel of the named server, if it is wrapped
+// by ngrok and its tunnels are up.
+func serverTunnel(server string) *pooledTunnel {
+	wrappersMu.Lock()
+	defer wrappersMu.Unlock()
+
+	for i := len(wrappers) - 1; i >= 0; i-- {
+		w := wrappers[i]
+		if w.server != server {
+			continue
+		}
+
+		if !w.started() || len(w.pooled) == 0 {
+			return nil
+		}
+
+		return w.pooled[0]
+	}
+
+	return nil
+}
+
+// sessionTunnel returns the first tunnel of the named server if it is wrapped
+// by ngrok, or else of the most recently started wrapper, if its tunnels are
+// up.
+func sessionTunnel(server string) *pooledTunnel {
+	wrappersMu.Lock()
+	defer wrappersMu.Unlock()
+
+	var latest *pooledTunnel
+	for i := len(wrappers) - 1; i >= 0; i-- {
+		w := wrappers[i]
+		up := w.started() && len(w.pooled) > 0
+
+		if w.server == server {
+			if !up {
+				return nil
+			}
+
+			return w.pooled[0]
+		}
+
+		if latest == nil && up {
+			latest = w.pooled[0]
+		}
+	}
+
+	return latest
+}
+
+// trackedConnOf returns the connection accepted from a tunnel that conn is,
+// looking through the connections wrapping it, such as TLS ones.
+func trackedConnOf(conn net.Conn) *trackedConn {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *trackedConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = placeholdersHandler{}
+	_ caddy.Module                = (*Placeholders)(nil)
+	_ caddy.Provisioner           = (*Placeholders)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Placeholders)(nil)
+	_ caddyfile.Unmarshaler       = (*Placeholders)(nil)
+)
@@ -0,0 +1,192 @@
+package ngroklistener
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/stretchr/testify/require"
+	"golang.ngrok.com/ngrok"
+)
+
+// regionSession is a fake ngrok session connected to a region.
+type regionSession struct {
+	*fakeSession
+}
+
+func (regionSession) Region() string { return "eu" }
+
+// httpGet sends a GET request over conn and returns the response body.
+func httpGet(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	defer conn.Close()
+
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	require.Nil(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+
+	return string(body)
+}
+
+// placeholdersTestConfig returns a config whose public server responds with
+// body, and whose internal server is also wrapped by ngrok.
+func placeholdersTestConfig(dir, body string) string {
+	return fmt.Sprintf(`{
+	"admin": {"disabled": true},
+	"apps": {
+		"http": {
+			"servers": {
+				"public": {
+					"listen": ["unix/%s/public.sock"],
+					"listener_wrappers": [{
+						"wrapper": "ngrok",
+						"auth_token": "placeholders-test",
+						"keep_local": true,
+						"tunnels": [{"type": "http", "domain": "public.example.com"}]
+					}],
+					"routes": [{
+						"handle": [{"handler": "static_response", "body": %q}]
+					}]
+				},
+				"internal": {
+					"listen": ["unix/%s/internal.sock"],
+					"listener_wrappers": [{
+						"wrapper": "ngrok",
+						"auth_token": "placeholders-test",
+						"tunnels": [{"type": "tcp"}]
+					}]
+				}
+			}
+		}
+	}
+}`, dir, body, dir)
+}
+
+func TestPlaceholders(t *testing.T) {
+	withConnect(t, func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error) {
+		return regionSession{&fakeSession{}}, nil
+	})
+
+	dir := t.TempDir()
+	runCaddy(t, placeholdersTestConfig(dir, "{ngrok.tunnels.public.url} {ngrok.tunnels.internal.id} {ngrok.session.region} {http.ngrok.tunnel.url}"))
+
+	public := serverTunnel("public")
+	require.NotNil(t, public)
+	publicTun, _ := public.current()
+
+	internal := serverTunnel("internal")
+	require.NotNil(t, internal)
+	internalTun, _ := internal.current()
+
+	client, err := publicTun.(*fakeTunnel).dial()
+	require.Nil(t, err)
+
+	url := publicTun.URL()
+	require.Equal(t, fmt.Sprintf("%s %s eu %s", url, internalTun.ID(), url), httpGet(t, client))
+
+	// requests served locally did not arrive on a tunnel
+	local, err := net.Dial("unix", dir+"/public.sock")
+	require.Nil(t, err)
+	require.Equal(t, fmt.Sprintf("%s %s eu ", url, internalTun.ID()), httpGet(t, local))
+}
+
+func TestPlaceholdersUnknown(t *testing.T) {
+	dir := t.TempDir()
+	runCaddy(t, placeholdersTestConfig(dir, "[{ngrok.tunnels.unknown.url}] [{ngrok.tunnels.public.unknown}] [{ngrok.unknown}]"))
+
+	local, err := net.Dial("unix", dir+"/public.sock")
+	require.Nil(t, err)
+	require.Equal(t, "[] [{ngrok.tunnels.public.unknown}] [{ngrok.unknown}]", httpGet(t, local))
+}
+
+func TestPlaceholdersOnUnwrappedServer(t *testing.T) {
+	withConnect(t, func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error) {
+		return regionSession{&fakeSession{}}, nil
+	})
+
+	dir := t.TempDir()
+	runCaddy(t, fmt.Sprintf(`{
+	"admin": {"disabled": true},
+	"apps": {
+		"http": {
+			"servers": {
+				"public": {
+					"listen": ["unix/%s/public.sock"],
+					"listener_wrappers": [{
+						"wrapper": "ngrok",
+						"auth_token": "placeholders-test",
+						"tunnels": [{"type": "http"}]
+					}]
+				},
+				"local": {
+					"listen": ["unix/%s/local.sock"],
+					"routes": [{
+						"handle": [
+							{"handler": "ngrok_placeholders"},
+							{"handler": "static_response", "body": "{ngrok.tunnels.public.url} {ngrok.session.region}"}
+						]
+					}]
+				}
+			}
+		}
+	}
+}`, dir, dir))
+
+	public := serverTunnel("public")
+	require.NotNil(t, public)
+	publicTun, _ := public.current()
+
+	local, err := net.Dial("unix", dir+"/local.sock")
+	require.Nil(t, err)
+	require.Equal(t, publicTun.URL()+" eu", httpGet(t, local))
+}
+
+func TestPlaceholdersCaddyfile(t *testing.T) {
+	adapter := caddyconfig.GetAdapter("caddyfile")
+	require.NotNil(t, adapter)
+
+	cfg, _, err := adapter.Adapt([]byte(`:8080 {
+		route {
+			ngrok_placeholders
+			redir {ngrok.tunnels.public.url}{uri}
+		}
+	}`), nil)
+	require.Nil(t, err)
+	require.Contains(t, string(cfg), `{"handler":"ngrok_placeholders"}`)
+
+	_, _, err = adapter.Adapt([]byte(`:8080 {
+		route {
+			ngrok_placeholders public
+		}
+	}`), nil)
+	require.NotNil(t, err)
+}
+
+func TestTrackedConnOf(t *testing.T) {
+	n := provisionNgrok(t, `ngrok {
+		tunnel tcp
+	}`)
+	defer n.Cleanup()
+
+	pt := n.pooled[0]
+	client, server := net.Pipe()
+	defer client.Close()
+
+	tracked := &trackedConn{Conn: server, tunnel: pt}
+	require.Same(t, tracked, trackedConnOf(tracked))
+	require.Same(t, tracked, trackedConnOf(tls.Server(tracked, &tls.Config{})))
+	require.Nil(t, trackedConnOf(localConn{server}))
+	require.Nil(t, trackedConnOf(nil))
+}
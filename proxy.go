@@ -0,0 +1,157 @@
+package ngroklistener
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.ngrok.com/ngrok"
+	"golang.org/x/net/proxy"
+)
+
+// proxyDialer returns a dialer connecting through the outbound proxy at
+// rawURL, using forward to reach the proxy itself. HTTP and HTTPS proxies are
+// tunneled through with CONNECT; SOCKS5 proxies are handled by x/net/proxy.
+// ngrok-go leaves HTTP proxies to x/net/proxy as well, which does not support
+// them, so both are dialed here.
+func proxyDialer(rawURL string, forward ngrok.Dialer) (ngrok.Dialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing proxy url: %v", err)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy url %s has no host", u.Redacted())
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return &connectDialer{proxy: u, forward: forward}, nil
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, forward)
+		if err != nil {
+			return nil, fmt.Errorf("configuring socks5 proxy: %v", err)
+		}
+
+		return contextDialer{d.(proxy.ContextDialer)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme '%s'; must be one of http, https, socks5", u.Scheme)
+	}
+}
+
+// contextDialer adapts an x/net/proxy dialer to ngrok.Dialer.
+type contextDialer struct {
+	proxy.ContextDialer
+}
+
+// Dial implements ngrok.Dialer
+func (d contextDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// connectDialer tunnels connections through an HTTP or HTTPS proxy using the
+// CONNECT method.
+type connectDialer struct {
+	proxy   *url.URL
+	forward ngrok.Dialer
+}
+
+// Dial implements ngrok.Dialer
+func (d *connectDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext implements ngrok.Dialer
+func (d *connectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	proxyAddr := d.proxy.Host
+	if d.proxy.Port() == "" {
+		port := "80"
+		if d.proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(d.proxy.Hostname(), port)
+	}
+
+	conn, err := d.forward.DialContext(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing proxy %s: %w", proxyAddr, err)
+	}
+
+	if d.proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname()})
+	}
+
+	// the handshake is bounded by the context; the tunneled connection is not
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+
+	tunneled, err := d.connect(conn, address)
+	if !stop() {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return tunneled, nil
+}
+
+// connect asks the proxy on conn to tunnel to address.
+func (d *connectDialer) connect(conn net.Conn, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+
+	if d.proxy.User != nil {
+		password, _ := d.proxy.User.Password()
+		req.SetBasicAuth(d.proxy.User.Username(), password)
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		req.Header.Del("Authorization")
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("sending CONNECT to proxy: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("reading CONNECT response from proxy: %w", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", address, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were already read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read implements net.Conn
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+var (
+	_ ngrok.Dialer = contextDialer{}
+	_ ngrok.Dialer = (*connectDialer)(nil)
+)
@@ -0,0 +1,201 @@
+package ngroklistener
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// proxyStub is a local proxy that records the address it was asked to reach,
+// answers the handshake, and then echoes whatever the client sends.
+type proxyStub struct {
+	ln      net.Listener
+	targets chan string
+}
+
+func newProxyStub(t *testing.T, handshake func(conn net.Conn, br *bufio.Reader) (string, bool)) *proxyStub {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	stub := &proxyStub{ln: ln, targets: make(chan string, 1)}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				br := bufio.NewReader(conn)
+				target, ok := handshake(conn, br)
+				stub.targets <- target
+				if !ok {
+					return
+				}
+
+				_, _ = io.Copy(conn, br)
+			}()
+		}
+	}()
+
+	return stub
+}
+
+// newConnectStub starts an HTTP proxy accepting CONNECT requests. If auth is
+// set, requests must carry it as their Proxy-Authorization.
+func newConnectStub(t *testing.T, auth string) *proxyStub {
+	return newProxyStub(t, func(conn net.Conn, br *bufio.Reader) (string, bool) {
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect {
+			return "", false
+		}
+
+		if auth != "" && req.Header.Get("Proxy-Authorization") != auth {
+			_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return req.Host, false
+		}
+
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return req.Host, true
+	})
+}
+
+// newSOCKS5Stub starts a SOCKS5 proxy accepting user/password
+// authentication with any credentials, or none.
+func newSOCKS5Stub(t *testing.T) *proxyStub {
+	return newProxyStub(t, func(conn net.Conn, br *bufio.Reader) (string, bool) {
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(br, greeting); err != nil {
+			return "", false
+		}
+		methods := make([]byte, greeting[1])
+		if _, err := io.ReadFull(br, methods); err != nil {
+			return "", false
+		}
+
+		method := byte(0x00)
+		for _, m := range methods {
+			if m == 0x02 {
+				method = 0x02
+			}
+		}
+		_, _ = conn.Write([]byte{0x05, method})
+
+		if method == 0x02 {
+			ver, _ := br.ReadByte()
+			ulen, _ := br.ReadByte()
+			_, _ = br.Discard(int(ulen))
+			plen, _ := br.ReadByte()
+			_, _ = br.Discard(int(plen))
+			if ver != 0x01 {
+				return "", false
+			}
+			_, _ = conn.Write([]byte{0x01, 0x00})
+		}
+
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(br, header); err != nil || header[3] != 0x03 {
+			return "", false
+		}
+		hlen, _ := br.ReadByte()
+		host := make([]byte, hlen)
+		_, _ = io.ReadFull(br, host)
+		port := make([]byte, 2)
+		_, _ = io.ReadFull(br, port)
+
+		_, _ = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+		return net.JoinHostPort(string(host), strconv.Itoa(int(binary.BigEndian.Uint16(port)))), true
+	})
+}
+
+// requireEcho checks that conn reaches the echoing stub.
+func requireEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	_, err := io.WriteString(conn, "ping")
+	require.Nil(t, err)
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(t, err)
+	require.Equal(t, "ping", string(buf))
+}
+
+func TestProxyDialerConnect(t *testing.T) {
+	stub := newConnectStub(t, "Basic dXNlcjpwYXNz")
+
+	dialer, err := proxyDialer("http://user:pass@"+stub.ln.Addr().String(), &net.Dialer{})
+	require.Nil(t, err)
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", "connect.ngrok-agent.com:443")
+	require.Nil(t, err)
+	defer conn.Close()
+
+	require.Equal(t, "connect.ngrok-agent.com:443", <-stub.targets)
+	requireEcho(t, conn)
+}
+
+func TestProxyDialerConnectRefused(t *testing.T) {
+	stub := newConnectStub(t, "Basic dXNlcjpwYXNz")
+
+	dialer, err := proxyDialer("http://user:wrong@"+stub.ln.Addr().String(), &net.Dialer{})
+	require.Nil(t, err)
+
+	_, err = dialer.Dial("tcp", "connect.ngrok-agent.com:443")
+	require.ErrorContains(t, err, "407")
+}
+
+func TestProxyDialerConnectTimeout(t *testing.T) {
+	// a proxy that never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	dialer, err := proxyDialer("http://"+ln.Addr().String(), &net.Dialer{})
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = dialer.DialContext(ctx, "tcp", "connect.ngrok-agent.com:443")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestProxyDialerSOCKS5(t *testing.T) {
+	for _, rawURL := range []string{"socks5://%s", "socks5://user:pass@%s"} {
+		stub := newSOCKS5Stub(t)
+
+		dialer, err := proxyDialer(fmt.Sprintf(rawURL, stub.ln.Addr()), &net.Dialer{})
+		require.Nil(t, err)
+
+		conn, err := dialer.DialContext(context.Background(), "tcp", "connect.ngrok-agent.com:443")
+		require.Nil(t, err)
+
+		require.Equal(t, "connect.ngrok-agent.com:443", <-stub.targets)
+		requireEcho(t, conn)
+		require.Nil(t, conn.Close())
+	}
+}
+
+func TestProxyDialerInvalid(t *testing.T) {
+	for _, rawURL := range []string{"ftp://proxy.example.com", "http://", "://proxy"} {
+		_, err := proxyDialer(rawURL, &net.Dialer{})
+		require.NotNil(t, err, rawURL)
+	}
+}
@@ -0,0 +1,339 @@
+package ngroklistener
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// wrappers holds the provisioned listener wrappers, in provisioning order, so
+// that the admin API can open tunnels on their sessions at runtime.
+var (
+	wrappersMu sync.Mutex
+	wrappers   []*Ngrok
+)
+
+func registerWrapper(n *Ngrok) {
+	wrappersMu.Lock()
+	defer wrappersMu.Unlock()
+
+	wrappers = append(wrappers, n)
+}
+
+func unregisterWrapper(n *Ngrok) {
+	wrappersMu.Lock()
+	defer wrappersMu.Unlock()
+
+	for i, w := range wrappers {
+		if w == n {
+			wrappers = append(wrappers[:i], wrappers[i+1:]...)
+			return
+		}
+	}
+}
+
+// errNoWrapper is returned by findWrapper when no listener wrapper matches.
+var errNoWrapper = errors.New("no ngrok listener wrapper")
+
+// findWrapper returns the most recently provisioned wrapper of the named
+// server, which belongs to the config currently running. With no name, there
+// must be a single server wrapped by ngrok.
+func findWrapper(server string) (*Ngrok, error) {
+	wrappersMu.Lock()
+	defer wrappersMu.Unlock()
+
+	if server == "" {
+		servers := map[string]struct{}{}
+		for _, w := range wrappers {
+			servers[w.server] = struct{}{}
+		}
+
+		if len(servers) > 1 {
+			return nil, fmt.Errorf("several servers are wrapped by ngrok; choose one with the 'server' query parameter")
+		}
+	}
+
+	for i := len(wrappers) - 1; i >= 0; i-- {
+		if server == "" || wrappers[i].server == server {
+			return wrappers[i], nil
+		}
+	}
+
+	if server == "" {
+		return nil, errNoWrapper
+	}
+
+	return nil, fmt.Errorf("%w for server '%s'", errNoWrapper, server)
+}
+
+// runtimeTunnelSeq numbers the tunnels opened at runtime, keeping their pool
+// keys unique.
+var runtimeTunnelSeq atomic.Uint64
+
+// runtimeTunnels are the tunnels opened through the admin API on the session
+// of a listener wrapper. They are served alongside the configured tunnels,
+// and closed with the config.
+type runtimeTunnels struct {
+	mu       sync.Mutex
+	pooled   map[*pooledTunnel]struct{}
+	released bool
+
+	// connections accepted from any of the tunnels
+	conns chan net.Conn
+}
+
+func newRuntimeTunnels() *runtimeTunnels {
+	return &runtimeTunnels{
+		pooled: make(map[*pooledTunnel]struct{}),
+		conns:  make(chan net.Conn),
+	}
+}
+
+// forward hands the connections accepted from pt to the runtime listeners,
+// until pt is closed.
+func (rt *runtimeTunnels) forward(pt *pooledTunnel) {
+	for {
+		select {
+		case conn := <-pt.conns:
+			select {
+			case rt.conns <- conn:
+			case <-pt.done:
+				_ = conn.Close()
+				return
+			}
+		case <-pt.done:
+			return
+		}
+	}
+}
+
+// started reports whether the session and configured tunnels are up.
+func (n *Ngrok) started() bool {
+	if n.ready == nil {
+		return true
+	}
+
+	select {
+	case <-n.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// openTunnel provisions a tunnel module from the JSON of its config, which
+// names its type inline, and opens it on the session of the wrapper.
+func (n *Ngrok) openTunnel(raw []byte) (*pooledTunnel, error) {
+	n.runtime.mu.Lock()
+	defer n.runtime.mu.Unlock()
+
+	if n.runtime.released {
+		return nil, errNoWrapper
+	}
+
+	if !n.started() {
+		return nil, fmt.Errorf("the ngrok session is not started yet")
+	}
+
+	tunnel, err := n.loadRuntimeTunnel(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := n.session
+	key := fmt.Sprintf("%s/runtime/%d", sess.key, runtimeTunnelSeq.Add(1))
+
+	val, _, err := tunnels.LoadOrNew(key, func() (caddy.Destructor, error) {
+		return sess.listen(key, tunnel.NgrokTunnel())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pt := val.(*pooledTunnel)
+	pt.setDrainTimeout(n.drainTimeout())
+	pt.setServer(n.server)
+
+	n.runtime.pooled[pt] = struct{}{}
+	go n.runtime.forward(pt)
+
+	n.l.Info("ngrok listening", zap.String("address", pt.Addr().String()), zap.Bool("runtime", true))
+	n.emit(eventTunnelStarted, n.tunnelData(pt))
+
+	return pt, nil
+}
+
+// loadRuntimeTunnel provisions a tunnel module in the config context of the
+// wrapper. The runtime lock must be held.
+func (n *Ngrok) loadRuntimeTunnel(raw []byte) (Tunnel, error) {
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &typed); err != nil {
+		return nil, fmt.Errorf("decoding ngrok tunnel: %v", err)
+	}
+
+	if typed.Type == "" {
+		return nil, fmt.Errorf("ngrok tunnel has no type")
+	}
+
+	// the module config must not carry its inline key
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("decoding ngrok tunnel: %v", err)
+	}
+	delete(fields, "type")
+
+	cfg, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("encoding ngrok tunnel: %v", err)
+	}
+
+	mod, err := n.ctx.LoadModuleByID("caddy.listeners.ngrok.tunnels."+typed.Type, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("loading ngrok tunnel module: %v", err)
+	}
+
+	tunnel, ok := mod.(Tunnel)
+	if !ok {
+		return nil, fmt.Errorf("loading ngrok tunnel module: %T is not an ngrok tunnel", mod)
+	}
+
+	return tunnel, nil
+}
+
+// closeRuntimeTunnel closes a tunnel opened by openTunnel. It reports false
+// if pt was not opened on this wrapper.
+func (n *Ngrok) closeRuntimeTunnel(pt *pooledTunnel) (bool, error) {
+	n.runtime.mu.Lock()
+
+	if _, ok := n.runtime.pooled[pt]; !ok {
+		n.runtime.mu.Unlock()
+		return false, nil
+	}
+
+	delete(n.runtime.pooled, pt)
+
+	closed, err := n.releaseRuntimeTunnel(pt)
+	n.runtime.mu.Unlock()
+
+	if closed {
+		pt.drain()
+	}
+
+	return true, err
+}
+
+// releaseRuntime closes the tunnels opened at runtime, and stops the wrapper
+// from opening more. It returns the tunnels it closed, which are left to drain.
+func (n *Ngrok) releaseRuntime() []*pooledTunnel {
+	if n.runtime == nil {
+		return nil
+	}
+
+	n.runtime.mu.Lock()
+	defer n.runtime.mu.Unlock()
+
+	n.runtime.released = true
+
+	var closed []*pooledTunnel
+	for pt := range n.runtime.pooled {
+		ok, err := n.releaseRuntimeTunnel(pt)
+		if err != nil {
+			n.l.Error("closing ngrok tunnel", zap.Error(err))
+		}
+
+		if ok {
+			closed = append(closed, pt)
+		}
+	}
+	n.runtime.pooled = nil
+
+	return closed
+}
+
+func (n *Ngrok) releaseRuntimeTunnel(pt *pooledTunnel) (bool, error) {
+	closed, err := releaseTunnel(pt.key)
+	if closed {
+		n.emit(eventTunnelStopped, n.tunnelData(pt))
+	}
+
+	return closed, err
+}
+
+// runtimeWrapper returns the wrapper that opened pt at runtime, if any.
+func runtimeWrapper(pt *pooledTunnel) *Ngrok {
+	wrappersMu.Lock()
+	defer wrappersMu.Unlock()
+
+	for _, w := range wrappers {
+		w.runtime.mu.Lock()
+		_, ok := w.runtime.pooled[pt]
+		w.runtime.mu.Unlock()
+
+		if ok {
+			return w
+		}
+	}
+
+	return nil
+}
+
+// runtimeListener accepts the connections of the tunnels opened at runtime on
+// a listener wrapper.
+type runtimeListener struct {
+	rt *runtimeTunnels
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newRuntimeListener(rt *runtimeTunnels) *runtimeListener {
+	return &runtimeListener{
+		rt:     rt,
+		closed: make(chan struct{}),
+	}
+}
+
+// Accept implements net.Listener
+func (l *runtimeListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	select {
+	case conn := <-l.rt.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener
+func (l *runtimeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+// Addr implements net.Listener
+func (l *runtimeListener) Addr() net.Addr {
+	return runtimeAddr{}
+}
+
+// runtimeAddr is the address of the listener of the tunnels opened at
+// runtime.
+type runtimeAddr struct{}
+
+// Network implements net.Addr
+func (runtimeAddr) Network() string { return "ngrok" }
+
+// String implements net.Addr
+func (runtimeAddr) String() string { return "ngrok (runtime tunnels)" }
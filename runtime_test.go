@@ -0,0 +1,71 @@
+package ngroklistener
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuntimeTunnelClosedWithConfig(t *testing.T) {
+	n := provisionNgrok(t, `ngrok {
+		tunnel tcp
+	}`)
+
+	pt, err := n.openTunnel([]byte(`{"type": "tls", "domain": "runtime.example.com"}`))
+	require.Nil(t, err)
+	require.Len(t, n.session.registered(), 2)
+
+	tun, _ := pt.current()
+
+	// runtime tunnels are served by the wrapped listener
+	conn := acceptOne(t, tun.(*fakeTunnel), n.WrapListener(nil))
+	require.Nil(t, conn.Close())
+
+	require.Nil(t, n.Cleanup())
+	require.True(t, tun.(*fakeTunnel).isClosed())
+
+	_, err = n.openTunnel([]byte(`{"type": "tcp"}`))
+	require.ErrorIs(t, err, errNoWrapper)
+}
+
+func TestFindWrapper(t *testing.T) {
+	_, err := findWrapper("")
+	require.ErrorIs(t, err, errNoWrapper)
+
+	first := provisionNgrok(t, `ngrok`)
+	defer first.Cleanup()
+	first.server = "first"
+
+	found, err := findWrapper("")
+	require.Nil(t, err)
+	require.Same(t, first, found)
+
+	// the wrapper of the config loaded last wins
+	reloaded := provisionNgrok(t, `ngrok`)
+	defer reloaded.Cleanup()
+	reloaded.server = "first"
+
+	found, err = findWrapper("first")
+	require.Nil(t, err)
+	require.Same(t, reloaded, found)
+
+	second := provisionNgrok(t, `ngrok`)
+	defer second.Cleanup()
+	second.server = "second"
+
+	_, err = findWrapper("")
+	require.ErrorContains(t, err, "choose one")
+
+	found, err = findWrapper("second")
+	require.Nil(t, err)
+	require.Same(t, second, found)
+
+	_, err = findWrapper("third")
+	require.ErrorIs(t, err, errNoWrapper)
+
+	unregisterWrapper(second)
+
+	found, err = findWrapper("")
+	require.Nil(t, err)
+	require.Same(t, reloaded, found)
+}
@@ -0,0 +1,244 @@
+package ngroklistener
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(new(EnvSecret))
+	caddy.RegisterModule(new(FileSecret))
+	caddy.RegisterModule(new(ExecSecret))
+}
+
+// SecretSource is implemented by the modules of the
+// caddy.listeners.ngrok.secrets namespace. They resolve the value of a
+// sensitive field, such as the auth token, while the config is provisioned,
+// so that the config only holds a reference to it. Resolved values are never
+// serialized nor logged.
+type SecretSource interface {
+	Secret() (string, error)
+}
+
+// secretHolder is implemented by the tunnels whose options hold secrets
+// resolved through a secret source.
+type secretHolder interface {
+	secrets() []string
+}
+
+// defaultExecSecretTimeout bounds the command of an exec secret source.
+const defaultExecSecretTimeout = 30 * time.Second
+
+// EnvSecret reads a secret from an environment variable.
+type EnvSecret struct {
+	// The name of the environment variable.
+	Name string `json:"name,omitempty"`
+}
+
+// CaddyModule implements caddy.Module
+func (*EnvSecret) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "caddy.listeners.ngrok.secrets.env",
+		New: func() caddy.Module {
+			return new(EnvSecret)
+		},
+	}
+}
+
+// Secret implements SecretSource
+func (s *EnvSecret) Secret() (string, error) {
+	value, ok := os.LookupEnv(s.Name)
+	if !ok || value == "" {
+		return "", fmt.Errorf("environment variable '%s' is not set", s.Name)
+	}
+
+	return value, nil
+}
+
+func (s *EnvSecret) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.AllArgs(&s.Name) {
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// FileSecret reads a secret from a file, such as a mounted Docker or
+// Kubernetes secret, without surrounding whitespace.
+type FileSecret struct {
+	// The path of the file.
+	Path string `json:"path,omitempty"`
+}
+
+// CaddyModule implements caddy.Module
+func (*FileSecret) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "caddy.listeners.ngrok.secrets.file",
+		New: func() caddy.Module {
+			return new(FileSecret)
+		},
+	}
+}
+
+// Secret implements SecretSource
+func (s *FileSecret) Secret() (string, error) {
+	return readSecretFile(s.Path)
+}
+
+func (s *FileSecret) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.AllArgs(&s.Path) {
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// ExecSecret runs a command and reads a secret from its output, without
+// surrounding whitespace.
+type ExecSecret struct {
+	// The command to run, with its arguments.
+	Command []string `json:"command,omitempty"`
+
+	// How long the command may run. Defaults to 30s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+// CaddyModule implements caddy.Module
+func (*ExecSecret) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "caddy.listeners.ngrok.secrets.exec",
+		New: func() caddy.Module {
+			return new(ExecSecret)
+		},
+	}
+}
+
+// Secret implements SecretSource. The output of the command is left out of
+// errors, as it may hold the secret.
+func (s *ExecSecret) Secret() (string, error) {
+	if len(s.Command) == 0 {
+		return "", fmt.Errorf("no command to run")
+	}
+
+	timeout := time.Duration(s.Timeout)
+	if timeout <= 0 {
+		timeout = defaultExecSecretTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...).Output()
+	if err != nil {
+		return "", fmt.Errorf("running '%s': %v", s.Command[0], err)
+	}
+
+	secret := strings.TrimSpace(string(out))
+	if secret == "" {
+		return "", fmt.Errorf("'%s' printed no secret", s.Command[0])
+	}
+
+	return secret, nil
+}
+
+func (s *ExecSecret) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		s.Command = d.RemainingArgs()
+		if len(s.Command) == 0 {
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// readSecretFile returns the secret in the file at path, without surrounding
+// whitespace.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("file '%s' is empty", path)
+	}
+
+	return secret, nil
+}
+
+// loadSecret resolves the secret source configured by raw, the named field of
+// structPointer, and reports false if there is none. literal is the value of
+// the field the source stands in for, which must then be empty.
+func loadSecret(ctx caddy.Context, structPointer any, fieldName string, raw json.RawMessage, literal string) (string, bool, error) {
+	if raw == nil {
+		return "", false, nil
+	}
+
+	if literal != "" {
+		return "", false, fmt.Errorf("a value and a secret source cannot both be set")
+	}
+
+	mod, err := ctx.LoadModule(structPointer, fieldName)
+	if err != nil {
+		return "", false, fmt.Errorf("loading secret source: %v", err)
+	}
+
+	source, ok := mod.(SecretSource)
+	if !ok {
+		return "", false, fmt.Errorf("%T is not a secret source", mod)
+	}
+
+	secret, err := source.Secret()
+	if err != nil {
+		return "", false, fmt.Errorf("resolving secret: %v", err)
+	}
+
+	return secret, true, nil
+}
+
+// unmarshalSecretSource parses a secret source from the remaining arguments:
+// its name, followed by its own arguments.
+func unmarshalSecretSource(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	var name string
+	if !d.Args(&name) {
+		return nil, d.ArgErr()
+	}
+
+	unm, err := caddyfile.UnmarshalModule(d, "caddy.listeners.ngrok.secrets."+name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := unm.(SecretSource); !ok {
+		return nil, d.Errf("module %s is not a secret source; is %T", name, unm)
+	}
+
+	return caddyconfig.JSONModuleObject(unm, "source", name, nil), nil
+}
+
+var (
+	_ caddy.Module          = (*EnvSecret)(nil)
+	_ SecretSource          = (*EnvSecret)(nil)
+	_ caddyfile.Unmarshaler = (*EnvSecret)(nil)
+	_ caddy.Module          = (*FileSecret)(nil)
+	_ SecretSource          = (*FileSecret)(nil)
+	_ caddyfile.Unmarshaler = (*FileSecret)(nil)
+	_ caddy.Module          = (*ExecSecret)(nil)
+	_ SecretSource          = (*ExecSecret)(nil)
+	_ caddyfile.Unmarshaler = (*ExecSecret)(nil)
+)
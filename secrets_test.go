@@ -0,0 +1,392 @@
+package ngroklistener
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/require"
+	"golang.ngrok.com/ngrok/config"
+)
+
+func TestSecretSources(t *testing.T) {
+	t.Setenv("NGROK_TEST_SECRET", "from-env")
+
+	path := filepath.Join(t.TempDir(), "secret")
+	require.Nil(t, os.WriteFile(path, []byte(" from-file\n"), 0o600))
+
+	env := &EnvSecret{Name: "NGROK_TEST_SECRET"}
+	secret, err := env.Secret()
+	require.Nil(t, err)
+	require.Equal(t, "from-env", secret)
+
+	_, err = (&EnvSecret{Name: "NGROK_TEST_SECRET_UNSET"}).Secret()
+	require.NotNil(t, err)
+
+	secret, err = (&FileSecret{Path: path}).Secret()
+	require.Nil(t, err)
+	require.Equal(t, "from-file", secret)
+
+	_, err = (&FileSecret{Path: filepath.Join(t.TempDir(), "missing")}).Secret()
+	require.NotNil(t, err)
+
+	secret, err = (&ExecSecret{Command: []string{"echo", " from-exec "}}).Secret()
+	require.Nil(t, err)
+	require.Equal(t, "from-exec", secret)
+
+	_, err = (&ExecSecret{Command: []string{"true"}}).Secret()
+	require.NotNil(t, err)
+
+	_, err = (&ExecSecret{Command: []string{"sh", "-c", "echo leaked; exit 1"}}).Secret()
+	require.NotNil(t, err)
+	require.NotContains(t, err.Error(), "leaked")
+
+	_, err = (&ExecSecret{Command: []string{"sleep", "5"}, Timeout: caddy.Duration(10e6)}).Secret()
+	require.NotNil(t, err)
+}
+
+func TestUnmarshalSecretSource(t *testing.T) {
+	cases := []struct {
+		name      string
+		input     string
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:     "env",
+			input:    `auth_token_source env NGROK_AUTHTOKEN`,
+			expected: `{"name":"NGROK_AUTHTOKEN","source":"env"}`,
+		},
+		{
+			name:     "file",
+			input:    `auth_token_source file /run/secrets/ngrok`,
+			expected: `{"path":"/run/secrets/ngrok","source":"file"}`,
+		},
+		{
+			name:     "exec",
+			input:    `auth_token_source exec vault read -field=token secret/ngrok`,
+			expected: `{"command":["vault","read","-field=token","secret/ngrok"],"source":"exec"}`,
+		},
+		{
+			name:      "no source",
+			input:     `auth_token_source`,
+			expectErr: true,
+		},
+		{
+			name:      "unknown source",
+			input:     `auth_token_source vault secret/ngrok`,
+			expectErr: true,
+		},
+		{
+			name:      "env no name",
+			input:     `auth_token_source env`,
+			expectErr: true,
+		},
+		{
+			name:      "file too many args",
+			input:     `auth_token_source file one two`,
+			expectErr: true,
+		},
+		{
+			name:      "exec no command",
+			input:     `auth_token_source exec`,
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser(tc.input)
+			require.True(t, d.Next())
+
+			raw, err := unmarshalSecretSource(d)
+			if tc.expectErr {
+				require.NotNil(t, err)
+				return
+			}
+
+			require.Nil(t, err)
+			require.JSONEq(t, tc.expected, string(raw))
+		})
+	}
+}
+
+func TestLoadSecret(t *testing.T) {
+	t.Setenv("NGROK_TEST_SECRET", "from-env")
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	source := json.RawMessage(`{"source": "env", "name": "NGROK_TEST_SECRET"}`)
+
+	secret, ok, err := loadSecret(ctx, &Ngrok{AuthTokenSourceRaw: source}, "AuthTokenSourceRaw", source, "")
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, "from-env", secret)
+
+	_, ok, err = loadSecret(ctx, &Ngrok{}, "AuthTokenSourceRaw", nil, "literal")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// a source does not go along with a value
+	_, _, err = loadSecret(ctx, &Ngrok{AuthTokenSourceRaw: source}, "AuthTokenSourceRaw", source, "literal")
+	require.NotNil(t, err)
+
+	unset := json.RawMessage(`{"source": "env", "name": "NGROK_TEST_SECRET_UNSET"}`)
+	_, _, err = loadSecret(ctx, &Ngrok{AuthTokenSourceRaw: unset}, "AuthTokenSourceRaw", unset, "")
+	require.NotNil(t, err)
+}
+
+func TestNgrokAuthTokenSource(t *testing.T) {
+	t.Setenv("NGROK_TEST_SECRET", "from-env")
+
+	tokenFile := filepath.Join(t.TempDir(), "authtoken")
+	require.Nil(t, os.WriteFile(tokenFile, []byte("from-file"), 0o600))
+
+	cases := genericNgrokTestCases[*Ngrok]{
+		{
+			name: "auth_token_source",
+			caddyInput: `ngrok {
+				auth_token_source env NGROK_TEST_SECRET
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.JSONEq(t, `{"source":"env","name":"NGROK_TEST_SECRET"}`, string(actual.AuthTokenSourceRaw))
+			},
+			expectedOptsFunc: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, "from-env", actual.authToken())
+
+				// the resolved token is not part of the config
+				data, err := json.Marshal(actual)
+				require.Nil(t, err)
+				require.NotContains(t, string(data), "from-env")
+			},
+		},
+		{
+			name: "auth_token_source with auth_token",
+			caddyInput: `ngrok {
+				auth_token foo
+				auth_token_source env NGROK_TEST_SECRET
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, "foo", actual.AuthToken)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "auth_token_source with auth_token_file",
+			caddyInput: `ngrok {
+				auth_token_file ` + tokenFile + `
+				auth_token_source env NGROK_TEST_SECRET
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, tokenFile, actual.AuthTokenFile)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "auth_token_source unresolved",
+			caddyInput: `ngrok {
+				auth_token_source env NGROK_TEST_SECRET_UNSET
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.NotNil(t, actual.AuthTokenSourceRaw)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "auth_token_source-no-arg",
+			caddyInput: `ngrok {
+				auth_token_source
+			}`,
+			expectUnmarshalErr: true,
+		},
+	}
+	cases.runAll(t)
+}
+
+func TestHTTPSecretSources(t *testing.T) {
+	t.Setenv("NGROK_TEST_PASSWORD", "from-env-password")
+	t.Setenv("NGROK_TEST_SHORT", "short")
+	t.Setenv("NGROK_TEST_SECRET", "from-env")
+
+	class := genericTestCases[*HTTP]{
+		{
+			name: "basic_auth_source",
+			caddyInput: `http {
+				basic_auth foo barbarbar
+				basic_auth_source bar env NGROK_TEST_PASSWORD
+			}`,
+			expectConfig: func(t *testing.T, actual *HTTP) {
+				require.Len(t, actual.BasicAuth, 2)
+				require.Equal(t, "bar", actual.BasicAuth[1].Username)
+				require.Empty(t, actual.BasicAuth[1].Password)
+				require.JSONEq(t, `{"source":"env","name":"NGROK_TEST_PASSWORD"}`, string(actual.BasicAuth[1].PasswordSourceRaw))
+			},
+			expectedOpts: config.HTTPEndpoint(
+				config.WithBasicAuth("foo", "barbarbar"),
+				config.WithBasicAuth("bar", "from-env-password"),
+			),
+		},
+		{
+			name: "basic_auth_source short password",
+			caddyInput: `http {
+				basic_auth_source bar env NGROK_TEST_SHORT
+			}`,
+			expectConfig: func(t *testing.T, actual *HTTP) {
+				require.Len(t, actual.BasicAuth, 1)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "basic_auth_source no source",
+			caddyInput: `http {
+				basic_auth_source bar
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "client_secret_source",
+			caddyInput: `http {
+				oidc {
+					issuer_url https://google.com
+					client_id foo
+					client_secret_source env NGROK_TEST_SECRET
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *HTTP) {
+				require.Empty(t, actual.OIDC.ClientSecret)
+				require.NotNil(t, actual.OIDC.ClientSecretSourceRaw)
+			},
+			expectedOpts: config.HTTPEndpoint(
+				config.WithOIDC("https://google.com", "foo", "from-env"),
+			),
+		},
+		{
+			name: "client_secret_source with client_secret",
+			caddyInput: `http {
+				oidc {
+					issuer_url https://google.com
+					client_id foo
+					client_secret bar
+					client_secret_source env NGROK_TEST_SECRET
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *HTTP) {
+				require.Equal(t, "bar", actual.OIDC.ClientSecret)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "webhook_verification secret_source",
+			caddyInput: `http {
+				webhook_verification {
+					provider github
+					secret_source env NGROK_TEST_SECRET
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *HTTP) {
+				require.Empty(t, actual.WebhookVerification.Secret)
+				require.NotNil(t, actual.WebhookVerification.SecretSourceRaw)
+			},
+			expectedOpts: config.HTTPEndpoint(
+				config.WithWebhookVerification("github", "from-env"),
+			),
+		},
+		{
+			name: "webhook_verification secret_source unresolved",
+			caddyInput: `http {
+				webhook_verification {
+					provider github
+					secret_source env NGROK_TEST_SECRET_UNSET
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *HTTP) {
+				require.NotNil(t, actual.WebhookVerification.SecretSourceRaw)
+			},
+			expectProvisionErr: true,
+		},
+	}
+	class.runAll(t)
+}
+
+func TestHTTPSecretsNotSerialized(t *testing.T) {
+	t.Setenv("NGROK_TEST_SECRET", "from-env-secret")
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	source := json.RawMessage(`{"source": "env", "name": "NGROK_TEST_SECRET"}`)
+	tun := &HTTP{
+		BasicAuth:           []basicAuthCred{{Username: "foo", PasswordSourceRaw: source}},
+		OIDC:                &oidc{IssuerURL: "https://google.com", ClientID: "foo", ClientSecretSourceRaw: source},
+		WebhookVerification: &webhookVerification{Provider: "github", SecretSourceRaw: source},
+	}
+	require.Nil(t, tun.Provision(ctx))
+
+	data, err := json.Marshal(tun)
+	require.Nil(t, err)
+	require.NotContains(t, string(data), "from-env-secret")
+
+	// the fingerprint still tells a rotated secret apart
+	before := tunnelFingerprint(tun)
+	tun.WebhookVerification.secret = "rotated"
+	require.NotEqual(t, before, tunnelFingerprint(tun))
+}
+
+func TestNotifySecretSource(t *testing.T) {
+	t.Setenv("NGROK_TEST_SECRET", "from-env-secret")
+
+	cases := genericNgrokTestCases[*Ngrok]{
+		{
+			name: "notify secret_source",
+			caddyInput: `ngrok {
+				notify {
+					url http://127.0.0.1:9/hook
+					secret_source env NGROK_TEST_SECRET
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Empty(t, actual.Notify.Secret)
+				require.JSONEq(t, `{"source":"env","name":"NGROK_TEST_SECRET"}`, string(actual.Notify.SecretSourceRaw))
+
+				// nothing listens on the discard port; do not retry
+				actual.Notify.Retries = new(int)
+			},
+			expectedOptsFunc: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, "from-env-secret", actual.Notify.secret)
+
+				data, err := json.Marshal(actual)
+				require.Nil(t, err)
+				require.NotContains(t, string(data), "from-env-secret")
+			},
+		},
+		{
+			name: "notify secret_source with secret",
+			caddyInput: `ngrok {
+				notify {
+					url http://127.0.0.1:9/hook
+					secret s3cret
+					secret_source env NGROK_TEST_SECRET
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, "s3cret", actual.Notify.Secret)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "notify secret_source-no-arg",
+			caddyInput: `ngrok {
+				notify {
+					secret_source
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+	}
+	cases.runAll(t)
+}
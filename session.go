@@ -0,0 +1,521 @@
+package ngroklistener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.ngrok.com/ngrok"
+	"golang.ngrok.com/ngrok/config"
+)
+
+// sessions holds the ngrok agent sessions shared between listener wrappers,
+// keyed by the options the session was connected with. Sharing a session
+// keeps the number of agent sessions (and heartbeats) down to one per
+// distinct set of connection options.
+var sessions = caddy.NewUsagePool()
+
+// session is a pooled ngrok agent session. It is not tied to the lifetime of
+// any single config, and is closed once the last listener wrapper using it is
+// cleaned up. The ngrok session behind it is replaced when it is restarted,
+// and its tunnels are reopened on the new one.
+type session struct {
+	key      string
+	opts     []ngrok.ConnectOption
+	commands remoteCommands
+
+	// the auth token read from the auth token file the session is connected
+	// with; guarded by lifecycle and mu
+	authtoken string
+
+	mu        sync.Mutex
+	observers map[sessionObserver]uint64 // by order of observing
+	observed  uint64
+	tunnels   map[*pooledTunnel]struct{}
+
+	// events emits the events of the session off ngrok-go's handlers
+	events serialQueue
+
+	// connection state, as last reported by ngrok-go
+	generation     uint64 // of the ngrok session the state is about
+	connected      bool
+	connectedSince time.Time
+	lastHeartbeat  time.Time
+	latency        time.Duration
+
+	// lifecycle serializes connecting, stopping and closing the session
+	lifecycle sync.Mutex
+	current   ngrok.Session // also guarded by mu
+	cancel    context.CancelFunc
+	stopped   bool
+	halted    bool // stopped by stop rather than by a failed reconnect
+
+	everConnected atomic.Bool
+}
+
+// sessionObserver is notified of lifecycle changes of a pooled session.
+// Notifications are delivered on ngrok-go's handler goroutines.
+type sessionObserver interface {
+	sessionConnected(s *session, reconnected bool)
+	sessionDisconnected(s *session, err error)
+	sessionHeartbeat(s *session, latency time.Duration)
+	sessionCommand(s *session, command string)
+}
+
+// id is a short, non-secret identifier for the session.
+func (s *session) id() string {
+	return s.key[:16]
+}
+
+// region returns the ngrok region the session is connected to, if known.
+func (s *session) region() string {
+	s.mu.Lock()
+	current := s.current
+	s.mu.Unlock()
+
+	if r, ok := current.(interface{ Region() string }); ok {
+		return r.Region()
+	}
+
+	return ""
+}
+
+// sessionStatus is a snapshot of the connection state of a session.
+type sessionStatus struct {
+	Connected      bool
+	ConnectedSince time.Time
+	LastHeartbeat  time.Time
+	Latency        time.Duration
+}
+
+func (s *session) status() sessionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return sessionStatus{
+		Connected:      s.connected,
+		ConnectedSince: s.connectedSince,
+		LastHeartbeat:  s.lastHeartbeat,
+		Latency:        s.latency,
+	}
+}
+
+// The mark methods record what ngrok-go reported about the ngrok session of
+// generation gen. They change nothing and return false once that ngrok
+// session was replaced or closed, as its handlers keep firing for a while.
+
+// markConnected records that the session is connected, unless it already
+// was.
+func (s *session) markConnected(gen uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if gen != s.generation {
+		return false
+	}
+
+	if !s.connected {
+		s.connected = true
+		s.connectedSince = time.Now()
+	}
+
+	return true
+}
+
+func (s *session) markDisconnected(gen uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if gen != s.generation {
+		return false
+	}
+
+	s.connected = false
+
+	return true
+}
+
+func (s *session) markHeartbeat(gen uint64, latency time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if gen != s.generation {
+		return false
+	}
+
+	s.lastHeartbeat = time.Now()
+	s.latency = latency
+
+	return true
+}
+
+// retire marks the session disconnected, and ignores what ngrok-go reports
+// about the current ngrok session from now on. It is called before the ngrok
+// session is closed on purpose, so that closing it is not reported as a
+// disconnect.
+func (s *session) retire() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.generation++
+	s.connected = false
+
+	return s.generation
+}
+
+func (s *session) observe(o sessionObserver) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.observed++
+	s.observers[o] = s.observed
+}
+
+func (s *session) unobserve(o sessionObserver) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.observers, o)
+}
+
+// emitsFor reports whether o is the observer that emits the events of the
+// session for all the wrappers sharing it: the last one to observe it, which
+// belongs to the most recent config.
+func (s *session) emitsFor(o sessionObserver) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.observers[o]
+	if !ok {
+		return false
+	}
+
+	for _, other := range s.observers {
+		if other > order {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *session) notify(fn func(sessionObserver)) {
+	s.mu.Lock()
+	observers := make([]sessionObserver, 0, len(s.observers))
+	for o := range s.observers {
+		observers = append(observers, o)
+	}
+	s.mu.Unlock()
+
+	for _, o := range observers {
+		fn(o)
+	}
+}
+
+// listen opens a tunnel for cfg on the session and registers it, so that it is
+// reopened when the session restarts.
+func (s *session) listen(key string, cfg config.Tunnel) (*pooledTunnel, error) {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	tun, err := s.current.Listen(context.Background(), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("starting ngrok tunnel: %w", err)
+	}
+
+	pt := newPooledTunnel(key, s, cfg, tun)
+
+	s.mu.Lock()
+	s.tunnels[pt] = struct{}{}
+	s.mu.Unlock()
+
+	return pt, nil
+}
+
+// forget removes a closed tunnel from the session.
+func (s *session) forget(pt *pooledTunnel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.tunnels, pt)
+}
+
+func (s *session) registered() []*pooledTunnel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tunnels := make([]*pooledTunnel, 0, len(s.tunnels))
+	for pt := range s.tunnels {
+		tunnels = append(tunnels, pt)
+	}
+
+	return tunnels
+}
+
+// stop closes the tunnels of the session, drains their connections and then
+// closes the ngrok session. The session stays pooled; the listeners using it
+// stop accepting until it is restarted, either remotely or by a config load.
+func (s *session) stop() {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	if s.stopped {
+		return
+	}
+
+	tunnels := s.registered()
+	for _, pt := range tunnels {
+		_ = pt.closeTunnel()
+	}
+	drainTunnels(tunnels)
+
+	s.disconnect()
+	s.halted = true
+}
+
+// restart reconnects the ngrok session and reopens its tunnels on the new
+// one. The old tunnels are closed first so that their domains are free to be
+// bound again; connections already accepted from them are left open.
+// Reconnecting is aborted if ctx is done.
+func (s *session) restart(ctx context.Context) error {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	err := s.reconnect(ctx)
+	if err != nil {
+		s.notify(func(o sessionObserver) { o.sessionDisconnected(s, err) })
+	}
+
+	return err
+}
+
+// resume reconnects the session if it was stopped remotely.
+func (s *session) resume(ctx context.Context) error {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	if !s.stopped {
+		return nil
+	}
+
+	return s.reconnect(ctx)
+}
+
+// reconnect replaces the ngrok session with a new one and reopens the
+// registered tunnels on it. The lifecycle lock must be held.
+func (s *session) reconnect(ctx context.Context) error {
+	tunnels := s.registered()
+
+	if !s.stopped {
+		for _, pt := range tunnels {
+			_ = pt.closeTunnel()
+		}
+		s.disconnect()
+	}
+
+	if err := s.dial(ctx); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, pt := range tunnels {
+		tun, err := s.current.Listen(context.Background(), pt.cfg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("restarting ngrok tunnel: %w", err))
+			continue
+		}
+
+		pt.replace(tun)
+	}
+
+	return errors.Join(errs...)
+}
+
+// disconnect closes the ngrok session. The lifecycle lock must be held.
+func (s *session) disconnect() {
+	s.retire()
+
+	if s.current != nil {
+		_ = s.current.Close()
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	s.stopped = true
+}
+
+// Destruct implements caddy.Destructor
+func (s *session) Destruct() error {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	if s.stopped {
+		return nil
+	}
+
+	defer s.cancel()
+	s.stopped = true
+	s.retire()
+
+	return s.current.Close()
+}
+
+// loadSession returns the pooled session for key, connecting a new one with
+// opts if none exists yet. authtoken is the token read from the auth token
+// file, if any, that opts connect with. Connecting is aborted if ctx is done.
+// Every successful call must be paired with a call to releaseSession.
+func loadSession(ctx context.Context, key, authtoken string, opts []ngrok.ConnectOption, commands remoteCommands) (sess *session, loaded bool, err error) {
+	val, loaded, err := sessions.LoadOrNew(key, func() (caddy.Destructor, error) {
+		s := &session{
+			key:       key,
+			authtoken: authtoken,
+			opts:      opts,
+			commands:  commands,
+			observers: make(map[sessionObserver]uint64),
+			tunnels:   make(map[*pooledTunnel]struct{}),
+		}
+
+		if err := s.dial(ctx); err != nil {
+			return nil, err
+		}
+
+		return s, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return val.(*session), loaded, nil
+}
+
+// releaseSession drops a reference to the pooled session for key, closing it
+// if it was the last one.
+func releaseSession(key string) error {
+	_, err := sessions.Delete(key)
+	return err
+}
+
+// dial connects a new ngrok session. ngrok-go retries failed connection
+// attempts indefinitely, so the first error reported before the session is
+// established aborts the attempt instead of leaving the config load hanging.
+// The attempt is also aborted if abort is done. The lifecycle lock must be
+// held, or the session not yet shared.
+func (s *session) dial(abort context.Context) error {
+	var (
+		connected  atomic.Bool
+		connectErr error
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// the handlers of an earlier ngrok session are ignored from now on
+	gen := s.retire()
+
+	opts := append(slices.Clip(s.opts), s.commands.connectOptions(s)...)
+	opts = append(opts,
+		ngrok.WithConnectHandler(func(context.Context, ngrok.Session) {
+			connected.Store(true)
+			if !s.markConnected(gen) {
+				return
+			}
+			reconnected := s.everConnected.Swap(true)
+			s.notify(func(o sessionObserver) { o.sessionConnected(s, reconnected) })
+		}),
+		ngrok.WithDisconnectHandler(func(_ context.Context, _ ngrok.Session, err error) {
+			if err != nil && connectErr == nil && !connected.Load() {
+				connectErr = err
+				cancel()
+			}
+			if !s.markDisconnected(gen) {
+				return
+			}
+			s.notify(func(o sessionObserver) { o.sessionDisconnected(s, err) })
+		}),
+		ngrok.WithHeartbeatHandler(func(_ context.Context, _ ngrok.Session, latency time.Duration) {
+			if !s.markHeartbeat(gen, latency) {
+				return
+			}
+			s.notify(func(o sessionObserver) { o.sessionHeartbeat(s, latency) })
+		}),
+	)
+
+	stop := context.AfterFunc(abort, cancel)
+
+	sess, err := connect(ctx, opts...)
+	switch aborted := !stop(); {
+	case aborted && err == nil:
+		s.retire()
+		_ = sess.Close()
+		fallthrough
+	case aborted:
+		err = abort.Err()
+	case err != nil && connectErr != nil:
+		err = connectErr
+	}
+
+	if err != nil {
+		s.retire()
+		cancel()
+		return fmt.Errorf("connecting ngrok session: %w", err)
+	}
+
+	s.mu.Lock()
+	s.current = sess
+	s.mu.Unlock()
+
+	s.markConnected(gen)
+
+	s.cancel = cancel
+	s.stopped = false
+	s.halted = false
+
+	return nil
+}
+
+// sessionKey identifies the session options of n. Listener wrappers with the
+// same key share one ngrok session.
+func (n *Ngrok) sessionKey() string {
+	// a token read from a file may rotate; the file identifies the session
+	authToken := n.authToken()
+	if n.AuthTokenFile != "" {
+		authToken = ""
+	}
+
+	return fingerprint(struct {
+		AuthToken          string
+		AuthTokenFile      string
+		Metadata           string
+		ClientInfo         clientInfo
+		Region             string
+		Server             string
+		ProxyURL           string
+		Dial               *dialOptions
+		CA                 []byte
+		TLSServerName      string
+		InsecureSkipVerify bool
+		HeartbeatTolerance caddy.Duration
+		HeartbeatInterval  caddy.Duration
+		RemoteCommands     remoteCommands
+	}{
+		AuthToken:          authToken,
+		AuthTokenFile:      n.AuthTokenFile,
+		Metadata:           n.Metadata,
+		ClientInfo:         n.clientInfo(),
+		Region:             n.Region,
+		Server:             n.Server,
+		ProxyURL:           n.ProxyURL,
+		Dial:               n.Dial,
+		CA:                 n.ca,
+		TLSServerName:      n.TLSServerName,
+		InsecureSkipVerify: n.InsecureSkipVerify,
+		HeartbeatTolerance: n.HeartbeatTolerance,
+		HeartbeatInterval:  n.HeartbeatInterval,
+		RemoteCommands:     n.RemoteCommands,
+	})
+}
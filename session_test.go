@@ -0,0 +1,187 @@
+package ngroklistener
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+	"golang.ngrok.com/ngrok"
+)
+
+// countingConnect returns a connect func recording every session it creates.
+func countingConnect(t *testing.T) *[]*fakeSession {
+	t.Helper()
+
+	var created []*fakeSession
+
+	withConnect(t, func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error) {
+		sess := &fakeSession{}
+		created = append(created, sess)
+		return sess, nil
+	})
+
+	return &created
+}
+
+func TestSessionShared(t *testing.T) {
+	created := countingConnect(t)
+
+	first := provisionNgrok(t, `ngrok {
+		auth_token shared
+		tunnel http
+	}`)
+	second := provisionNgrok(t, `ngrok {
+		auth_token shared
+		tunnel tcp
+	}`)
+
+	require.Len(t, *created, 1)
+	require.Same(t, first.session, second.session)
+	require.Len(t, (*created)[0].tunnels, 2)
+
+	require.Nil(t, first.Cleanup())
+	require.False(t, (*created)[0].isClosed())
+
+	require.Nil(t, second.Cleanup())
+	require.True(t, (*created)[0].isClosed())
+}
+
+func TestSessionKeyedByOptions(t *testing.T) {
+	created := countingConnect(t)
+
+	cases := []string{
+		`ngrok {
+			auth_token one
+		}`,
+		`ngrok {
+			auth_token two
+		}`,
+		`ngrok {
+			auth_token two
+			region eu
+		}`,
+		`ngrok {
+			auth_token two
+			server ingress.example.com:443
+		}`,
+	}
+
+	var wrappers []*Ngrok
+	for _, input := range cases {
+		wrappers = append(wrappers, provisionNgrok(t, input))
+	}
+
+	require.Len(t, *created, len(cases))
+
+	for _, n := range wrappers {
+		require.Nil(t, n.Cleanup())
+	}
+
+	for _, sess := range *created {
+		require.True(t, sess.isClosed())
+	}
+}
+
+// sessionHandlers are the ngrok-go handlers a session is connected with.
+type sessionHandlers struct {
+	connect    ngrok.SessionConnectHandler
+	disconnect ngrok.SessionDisconnectHandler
+	heartbeat  ngrok.SessionHeartbeatHandler
+}
+
+// handlersOf applies opts to an ngrok-go connect config, and returns the
+// handlers they set.
+func handlersOf(opts []ngrok.ConnectOption) sessionHandlers {
+	cfg := reflect.New(reflect.TypeOf(ngrok.ConnectOption(nil)).In(0).Elem())
+	for _, opt := range opts {
+		reflect.ValueOf(opt).Call([]reflect.Value{cfg})
+	}
+
+	var h sessionHandlers
+	h.connect, _ = cfg.Elem().FieldByName("ConnectHandler").Interface().(ngrok.SessionConnectHandler)
+	h.disconnect, _ = cfg.Elem().FieldByName("DisconnectHandler").Interface().(ngrok.SessionDisconnectHandler)
+	h.heartbeat, _ = cfg.Elem().FieldByName("HeartbeatHandler").Interface().(ngrok.SessionHeartbeatHandler)
+
+	return h
+}
+
+// handlingConnect returns a func returning the handlers of every session
+// connected during the test. Like ngrok-go, connecting calls the connect
+// handler.
+func handlingConnect(t *testing.T) func() []sessionHandlers {
+	t.Helper()
+
+	var (
+		mu       sync.Mutex
+		handlers []sessionHandlers
+	)
+
+	withConnect(t, func(ctx context.Context, opts ...ngrok.ConnectOption) (ngrok.Session, error) {
+		h := handlersOf(opts)
+
+		mu.Lock()
+		handlers = append(handlers, h)
+		mu.Unlock()
+
+		sess := &fakeSession{}
+		h.connect(ctx, sess)
+
+		return sess, nil
+	})
+
+	return func() []sessionHandlers {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]sessionHandlers(nil), handlers...)
+	}
+}
+
+func TestSessionHandlersOfClosedSessionIgnored(t *testing.T) {
+	rec := withEvents(t)
+	handlers := handlingConnect(t)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	n := loadNgrok(t, ctx, `{}`)
+	sess := n.session
+
+	require.Nil(t, sess.restart(context.Background()))
+	require.Len(t, handlers(), 2)
+	old, current := handlers()[0], handlers()[1]
+
+	// ngrok-go reports closing the replaced session, more than once
+	old.disconnect(context.Background(), nil, errors.New("closed by the client side"))
+	old.disconnect(context.Background(), nil, nil)
+	old.heartbeat(context.Background(), nil, time.Second)
+
+	current.heartbeat(context.Background(), nil, 42*time.Millisecond)
+	require.Eventually(t, func() bool { return len(rec.named(eventSessionHeartbeat)) == 1 }, time.Second, time.Millisecond)
+
+	require.Empty(t, rec.named(eventSessionDisconnected))
+	require.Len(t, rec.named(eventSessionReconnected), 1)
+	require.True(t, sess.status().Connected)
+	require.Equal(t, 42*time.Millisecond, sess.status().Latency)
+
+	current.disconnect(context.Background(), nil, errors.New("connection reset"))
+	require.Eventually(t, func() bool { return len(rec.named(eventSessionDisconnected)) == 1 }, time.Second, time.Millisecond)
+	require.False(t, sess.status().Connected)
+
+	current.connect(context.Background(), nil)
+	require.Eventually(t, func() bool { return len(rec.named(eventSessionReconnected)) == 2 }, time.Second, time.Millisecond)
+
+	// stopping the session on purpose is not reported as a disconnect; the
+	// handlers ignored emit nothing, not even later
+	sess.stop()
+	current.disconnect(context.Background(), nil, nil)
+	current.heartbeat(context.Background(), nil, time.Second)
+
+	require.False(t, sess.status().Connected)
+	require.Len(t, rec.named(eventSessionDisconnected), 1)
+	require.Len(t, rec.named(eventSessionHeartbeat), 1)
+}
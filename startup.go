@@ -0,0 +1,248 @@
+package ngroklistener
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Startup policies, for when ngrok cannot be reached while the config loads
+const (
+	startupFail       = "fail"
+	startupWait       = "wait"
+	startupBackground = "background"
+)
+
+// Bounds of the delay between two startup attempts. Tests shorten them.
+var (
+	startupBackoffMin = time.Second
+	startupBackoffMax = time.Minute
+)
+
+func (n *Ngrok) validateStartup() error {
+	switch n.Startup {
+	case "", startupFail, startupBackground:
+	case startupWait:
+		if n.StartupTimeout <= 0 {
+			return fmt.Errorf("startup policy '%s' requires a positive startup_timeout", startupWait)
+		}
+	default:
+		return fmt.Errorf("unrecognized startup policy '%s'", n.Startup)
+	}
+
+	return nil
+}
+
+// start establishes the session and tunnels as the startup policy says. If
+// that fails and a fallback is configured, the config loads anyway, falling
+// back while the tunnels keep being started in the background.
+func (n *Ngrok) start() error {
+	err := n.startWithPolicy()
+	if err == nil || n.fallback == nil {
+		return err
+	}
+
+	n.fallback.activate("startup failed", err)
+	n.startInBackground()
+
+	return nil
+}
+
+func (n *Ngrok) startWithPolicy() error {
+	switch n.Startup {
+	case startupWait:
+		ctx, cancel := context.WithTimeout(n.ctx, time.Duration(n.StartupTimeout))
+		defer cancel()
+
+		return n.startWithRetry(ctx)
+	case startupBackground:
+		n.startInBackground()
+
+		return nil
+	default:
+		return n.startTunnels(n.ctx)
+	}
+}
+
+// startWithRetry tries to start the tunnels until it succeeds or ctx is done,
+// backing off between attempts.
+func (n *Ngrok) startWithRetry(ctx context.Context) error {
+	var lastErr error
+
+	for attempt := 0; ; attempt++ {
+		err := n.startTunnels(ctx)
+		if err == nil {
+			return nil
+		}
+
+		// an attempt cut short by ctx says less than the one before it
+		if ctx.Err() == nil || lastErr == nil {
+			lastErr = err
+		}
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("giving up starting ngrok: %w", lastErr)
+		}
+
+		delay := startupBackoff(attempt)
+		n.l.Warn("starting ngrok failed; retrying", zap.Error(err), zap.Duration("retry_in", delay))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("giving up starting ngrok: %w", lastErr)
+		}
+	}
+}
+
+// startupBackoff returns the delay before the startup attempt following the
+// given one.
+func startupBackoff(attempt int) time.Duration {
+	return backoff(attempt, startupBackoffMin, startupBackoffMax)
+}
+
+// backoff returns the delay before the attempt following the given one:
+// exponential in the number of attempts from minDelay up to maxDelay, with up
+// to half of it jittered.
+func backoff(attempt int, minDelay, maxDelay time.Duration) time.Duration {
+	delay := maxDelay
+	if attempt < 32 && minDelay<<attempt < maxDelay {
+		delay = minDelay << attempt
+	}
+
+	half := delay / 2
+
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// startInBackground starts the tunnels without holding up the config load.
+// The listeners returned by WrapListener accept nothing from ngrok until the
+// tunnels are up, and fall back until then if configured to.
+func (n *Ngrok) startInBackground() {
+	if n.fallback != nil {
+		n.fallback.activate("starting in the background", nil)
+	}
+
+	ctx, cancel := context.WithCancel(n.ctx)
+
+	n.ready = make(chan struct{})
+	n.stopStartup = cancel
+	n.startupDone = make(chan struct{})
+
+	go func() {
+		defer close(n.startupDone)
+
+		if err := n.startWithRetry(ctx); err != nil {
+			n.l.Info("ngrok background startup stopped", zap.Error(err))
+			return
+		}
+
+		n.l.Info("ngrok started in the background")
+		close(n.ready)
+
+		if n.fallback != nil {
+			n.fallback.deactivate()
+		}
+	}()
+}
+
+// stopBackground gives up a background startup that is still retrying, and
+// waits for it to return.
+func (n *Ngrok) stopBackground() {
+	if n.stopStartup == nil {
+		return
+	}
+
+	n.stopStartup()
+	<-n.startupDone
+}
+
+// deferredListener is a listener whose underlying listener is only created
+// once ready is closed. Until then, Accept blocks.
+type deferredListener struct {
+	ready       <-chan struct{}
+	newListener func() net.Listener
+
+	once sync.Once
+	ln   net.Listener
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newDeferredListener(ready <-chan struct{}, newListener func() net.Listener) *deferredListener {
+	return &deferredListener{
+		ready:       ready,
+		newListener: newListener,
+		closed:      make(chan struct{}),
+	}
+}
+
+func (l *deferredListener) listener() net.Listener {
+	l.once.Do(func() { l.ln = l.newListener() })
+
+	return l.ln
+}
+
+func (l *deferredListener) isReady() bool {
+	select {
+	case <-l.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// Accept implements net.Listener
+func (l *deferredListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.ready:
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+
+	// Close may have run before the listener was ready, without closing it
+	select {
+	case <-l.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	return l.listener().Accept()
+}
+
+// Close implements net.Listener
+func (l *deferredListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+
+	if l.isReady() {
+		return l.listener().Close()
+	}
+
+	return nil
+}
+
+// Addr implements net.Listener
+func (l *deferredListener) Addr() net.Addr {
+	if l.isReady() {
+		return l.listener().Addr()
+	}
+
+	return pendingAddr{}
+}
+
+// pendingAddr is the address of a listener whose tunnels are not up yet.
+type pendingAddr struct{}
+
+// Network implements net.Addr
+func (pendingAddr) Network() string { return "ngrok" }
+
+// String implements net.Addr
+func (pendingAddr) String() string { return "ngrok (starting)" }
@@ -0,0 +1,284 @@
+package ngroklistener
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/require"
+	"golang.ngrok.com/ngrok"
+)
+
+// withStartupBackoff shortens the delay between startup attempts.
+func withStartupBackoff(t *testing.T) {
+	t.Helper()
+
+	minDelay, maxDelay := startupBackoffMin, startupBackoffMax
+	startupBackoffMin, startupBackoffMax = time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() { startupBackoffMin, startupBackoffMax = minDelay, maxDelay })
+}
+
+// flakyConnect fails to connect until up is set, counting the attempts.
+func flakyConnect(t *testing.T, up *atomic.Bool) *atomic.Int32 {
+	t.Helper()
+
+	var attempts atomic.Int32
+
+	withConnect(t, func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error) {
+		attempts.Add(1)
+		if !up.Load() {
+			return nil, errors.New("ingress unreachable")
+		}
+		return &fakeSession{}, nil
+	})
+
+	return &attempts
+}
+
+func TestNgrokStartup(t *testing.T) {
+	cases := genericNgrokTestCases[*Ngrok]{
+		{
+			name: "default",
+			caddyInput: `ngrok {
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Empty(t, actual.Startup)
+			},
+		},
+		{
+			name: "startup fail",
+			caddyInput: `ngrok {
+				startup fail
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, startupFail, actual.Startup)
+			},
+		},
+		{
+			name: "startup wait",
+			caddyInput: `ngrok {
+				startup wait 30s
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, startupWait, actual.Startup)
+				require.Equal(t, caddy.Duration(30*time.Second), actual.StartupTimeout)
+			},
+		},
+		{
+			name: "startup background",
+			caddyInput: `ngrok {
+				startup background
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, startupBackground, actual.Startup)
+			},
+		},
+		{
+			name: "startup wait without timeout",
+			caddyInput: `ngrok {
+				startup wait
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "startup wait parse-err",
+			caddyInput: `ngrok {
+				startup wait forever
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "startup unknown policy",
+			caddyInput: `ngrok {
+				startup eventually
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "startup-no-arg",
+			caddyInput: `ngrok {
+				startup
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "startup-too-many-arg",
+			caddyInput: `ngrok {
+				startup background 30s
+			}`,
+			expectUnmarshalErr: true,
+		},
+	}
+	cases.runAll(t)
+}
+
+func TestValidateStartup(t *testing.T) {
+	require.Nil(t, (&Ngrok{}).validateStartup())
+	require.Nil(t, (&Ngrok{Startup: startupWait, StartupTimeout: caddy.Duration(time.Second)}).validateStartup())
+	require.NotNil(t, (&Ngrok{Startup: startupWait}).validateStartup())
+	require.NotNil(t, (&Ngrok{Startup: "eventually"}).validateStartup())
+}
+
+func TestStartupBackoff(t *testing.T) {
+	withStartupBackoff(t)
+
+	for attempt, limit := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		limit *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			delay := startupBackoff(attempt)
+			require.GreaterOrEqual(t, delay, limit/2)
+			require.LessOrEqual(t, delay, limit)
+		}
+	}
+
+	// large attempt counts do not overflow
+	require.LessOrEqual(t, startupBackoff(1000), 10*time.Millisecond)
+	require.Greater(t, startupBackoff(1000), time.Duration(0))
+}
+
+func TestStartupFail(t *testing.T) {
+	var up atomic.Bool
+	attempts := flakyConnect(t, &up)
+
+	n := new(Ngrok)
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	require.ErrorContains(t, n.Provision(ctx), "ingress unreachable")
+	require.EqualValues(t, 1, attempts.Load())
+}
+
+func TestStartupWait(t *testing.T) {
+	withStartupBackoff(t)
+
+	var up atomic.Bool
+	attempts := flakyConnect(t, &up)
+
+	go func() {
+		for attempts.Load() < 3 {
+			time.Sleep(time.Millisecond)
+		}
+		up.Store(true)
+	}()
+
+	n := provisionNgrok(t, `ngrok {
+		startup wait 10s
+	}`)
+	defer n.Cleanup()
+
+	require.GreaterOrEqual(t, attempts.Load(), int32(3))
+	require.Len(t, n.pooled, 1)
+}
+
+func TestStartupWaitTimeout(t *testing.T) {
+	withStartupBackoff(t)
+
+	var up atomic.Bool
+	attempts := flakyConnect(t, &up)
+
+	n := new(Ngrok)
+	require.Nil(t, n.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`ngrok {
+		startup wait 50ms
+	}`)))
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	start := time.Now()
+	err := n.Provision(ctx)
+	require.ErrorContains(t, err, "ingress unreachable")
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	require.Greater(t, attempts.Load(), int32(1))
+}
+
+func TestStartupBackground(t *testing.T) {
+	withStartupBackoff(t)
+
+	var up atomic.Bool
+	attempts := flakyConnect(t, &up)
+
+	n := provisionNgrok(t, `ngrok {
+		startup background
+	}`)
+	defer n.Cleanup()
+
+	ln := n.WrapListener(nil)
+	require.Equal(t, pendingAddr{}, ln.Addr())
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		require.Nil(t, err)
+		accepted <- conn
+	}()
+
+	require.Eventually(t, func() bool { return attempts.Load() > 2 }, time.Second, time.Millisecond)
+	select {
+	case <-accepted:
+		t.Fatal("accepted before the tunnel was up")
+	default:
+	}
+
+	up.Store(true)
+	<-n.ready
+
+	client, err := fakeTunnelOf(t, n).dial()
+	require.Nil(t, err)
+	defer client.Close()
+
+	conn := <-accepted
+	require.Nil(t, conn.Close())
+	require.Equal(t, fakeTunnelOf(t, n).Addr(), ln.Addr())
+
+	require.Nil(t, ln.Close())
+	_, err = ln.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestStartupBackgroundCleanup(t *testing.T) {
+	withStartupBackoff(t)
+
+	var up atomic.Bool
+	attempts := flakyConnect(t, &up)
+
+	n := provisionNgrok(t, `ngrok {
+		startup background
+		keep_local
+	}`)
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	// the local listener serves while ngrok is still starting
+	ln := n.WrapListener(local)
+	require.Equal(t, local.Addr(), ln.Addr())
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		require.Nil(t, err)
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("tcp", local.Addr().String())
+	require.Nil(t, err)
+	defer client.Close()
+	require.Nil(t, (<-accepted).Close())
+
+	require.Eventually(t, func() bool { return attempts.Load() > 1 }, time.Second, time.Millisecond)
+
+	require.Nil(t, ln.Close())
+	_, err = ln.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	require.Nil(t, n.Cleanup())
+	seen := attempts.Load()
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, seen, attempts.Load())
+	require.Nil(t, n.session)
+}
@@ -1,7 +1,9 @@
 package ngroklistener
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/caddyserver/caddy/v2"
@@ -14,21 +16,37 @@ type webhookVerification struct {
 
 	Provider string `json:"provider,omitempty"`
 	Secret   string `json:"secret,omitempty"`
+
+	// SecretSourceRaw resolves the secret through a secret source module, as
+	// an alternative to secret.
+	SecretSourceRaw json.RawMessage `json:"secret_source,omitempty" caddy:"namespace=caddy.listeners.ngrok.secrets inline_key=source"`
+
+	// the secret in use, resolved from its source if it has one
+	secret string
 }
 
-func (wv *webhookVerification) Provision(caddy.Context) error {
+func (wv *webhookVerification) Provision(ctx caddy.Context) error {
 
 	wv.doReplace()
 
+	wv.secret = wv.Secret
+	secret, ok, err := loadSecret(ctx, wv, "SecretSourceRaw", wv.SecretSourceRaw, wv.Secret)
+	if err != nil {
+		return fmt.Errorf("webhookVerification `secret_source`: %v", err)
+	}
+	if ok {
+		wv.secret = secret
+	}
+
 	if strings.TrimSpace(wv.Provider) == "" {
 		return errors.New("webhookVerification `provider` cannot be empty string")
 	}
 
-	if strings.TrimSpace(wv.Secret) == "" {
+	if strings.TrimSpace(wv.secret) == "" {
 		return errors.New("webhookVerification `secret` cannot be empty string")
 	}
 
-	wv.opt = config.WithWebhookVerification(wv.Provider, wv.Secret)
+	wv.opt = config.WithWebhookVerification(wv.Provider, wv.secret)
 
 	return nil
 }
@@ -59,6 +77,13 @@ func (wv *webhookVerification) UnmarshalCaddyfile(d *caddyfile.Dispenser) error
 			if !d.AllArgs(&wv.Secret) {
 				return d.ArgErr()
 			}
+		case "secret_source":
+			source, err := unmarshalSecretSource(d)
+			if err != nil {
+				return d.Errf(`parsing secret_source %w`, err)
+			}
+
+			wv.SecretSourceRaw = source
 		default:
 			return d.Errf("unrecognized subdirective %s", subdirective)
 		}